@@ -0,0 +1,115 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/andrewmthomas87/web-p2p-tunnel/internal/tunnel"
+)
+
+const cookieStoreKeyEnv = "WEB_P2P_TUNNEL_COOKIE_STORE_KEY"
+
+// cookieStoreKeyOrEnv returns key, or the key in the environment if it's empty.
+func cookieStoreKeyOrEnv(key string) string {
+	if key == "" {
+		return os.Getenv(cookieStoreKeyEnv)
+	}
+
+	return key
+}
+
+// cookiesCommand lists or clears the jars of a cookie store.
+func cookiesCommand(args []string) {
+	fs := flag.NewFlagSet("cookies", flag.ExitOnError)
+	storePath := fs.String("cookie-store", "", "cookie store `directory`")
+	storeKey := fs.String("cookie-store-key", "", "`key` of the cookie store (default $"+cookieStoreKeyEnv+")")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: web-p2p-tunnel cookies -cookie-store directory list|clear [jar...]\n\n")
+		fmt.Fprintf(fs.Output(), "list lists the stored jars, and clear deletes the given jars, or all of them.\n\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	if *storePath == "" || fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	store, err := tunnel.NewCookieStore(*storePath, cookieStoreKeyOrEnv(*storeKey))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch fs.Arg(0) {
+	case "list":
+		if err := listCookieJars(store); err != nil {
+			log.Fatal(err)
+		}
+
+	case "clear":
+		ids := fs.Args()[1:]
+		if len(ids) == 0 {
+			jars, err := store.List()
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			for _, jar := range jars {
+				ids = append(ids, jar.ID)
+			}
+		}
+
+		for _, id := range ids {
+			if err := store.Delete(id); err != nil {
+				log.Fatal(err)
+			}
+
+			fmt.Printf("Deleted %s\n", id)
+		}
+
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+}
+
+func listCookieJars(store *tunnel.CookieStore) error {
+	jars, err := store.List()
+	if err != nil {
+		return err
+	}
+
+	for _, jar := range jars {
+		cookies, err := store.Load(jar.ID)
+		modified := jar.Modified.Format(time.DateTime)
+		if err != nil {
+			fmt.Printf("%s  %s  %v\n", jar.ID, modified, err)
+			continue
+		}
+
+		domains := make(map[string]bool)
+		for _, c := range cookies {
+			domain := strings.TrimPrefix(c.Domain, ".")
+			if u, err := url.Parse(c.URL); domain == "" && err == nil {
+				domain = u.Hostname()
+			}
+
+			domains[domain] = true
+		}
+		names := make([]string, 0, len(domains))
+		for domain := range domains {
+			names = append(names, domain)
+		}
+		sort.Strings(names)
+
+		fmt.Printf("%s  %s  %d cookies  %s\n", jar.ID, modified, len(cookies), strings.Join(names, " "))
+	}
+
+	return nil
+}
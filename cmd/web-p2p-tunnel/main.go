@@ -4,9 +4,11 @@ import (
 	"context"
 	"flag"
 	"log"
+	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"strings"
 	"time"
 
 	"github.com/andrewmthomas87/web-p2p-tunnel/internal/signaling"
@@ -17,24 +19,157 @@ import (
 
 var (
 	signalingServerURLStr = flag.String("signaling-server-url", "http://localhost:8080", "signaling server url")
-	tunnelTargetURLStr    = flag.String("tunnel-target-url", "", "tunnel target url")
-	changeHostHeader      = flag.Bool(
+	tunnelTargetURLStr    = flag.String("tunnel-target-url", "", "tunnel target url, shorthand for -route /=url")
+	servePath             = flag.String(
+		"serve",
+		"",
+		"serve a directory or zip/tar archive instead of proxying, shorthand for -route /=file:`path[,option...]`",
+	)
+	changeHostHeader = flag.Bool(
 		"change-host-header",
 		false,
-		"change the Host header to the host of the target url",
+		"change the Host header to the host of the target url (default for routes)",
 	)
 	changeOriginHeader = flag.Bool(
 		"change-origin-header",
 		false,
-		"change the Origin header to the origin of the target url",
+		"change the Origin header to the origin of the target url (default for routes)",
+	)
+	rewriteURLs = flag.String(
+		"rewrite-urls",
+		"",
+		"rewrite target urls in responses to paths if `mode` is relative, or tunnel urls if origin (default for routes)",
+	)
+	tlsCA = flag.String(
+		"tls-ca",
+		"",
+		"PEM `file` of certificate authorities to trust for https targets, in addition to the system's (default for routes)",
+	)
+	tlsInsecureSkipVerify = flag.Bool(
+		"tls-insecure-skip-verify",
+		false,
+		"don't verify the certificates of https targets (default for routes)",
+	)
+	tlsServerName = flag.String(
+		"tls-server-name",
+		"",
+		"server `name` to send and verify for https targets, instead of the target's host (default for routes)",
+	)
+	tlsCert = flag.String(
+		"tls-cert",
+		"",
+		"PEM client certificate `file` to present to https targets, with tls-key (default for routes)",
+	)
+	tlsKey = flag.String(
+		"tls-key",
+		"",
+		"PEM client key `file` to present to https targets, with tls-cert (default for routes)",
+	)
+	bufferedAmountHighThreshold = flag.Uint64(
+		"buffered-amount-high-threshold",
+		tunnel.DefaultFlowControl.HighThreshold,
+		"data channel buffered amount (bytes) above which sending pauses",
+	)
+	bufferedAmountLowThreshold = flag.Uint64(
+		"buffered-amount-low-threshold",
+		tunnel.DefaultFlowControl.LowThreshold,
+		"data channel buffered amount (bytes) at which paused sending resumes",
+	)
+	httpMux = flag.Bool(
+		"http-mux",
+		true,
+		"allow clients to multiplex HTTP requests over a single data channel",
+	)
+
+	unknownHostStatus = flag.Int(
+		"unknown-host-status",
+		0,
+		"status (421 or 404) of responses to requests for hosts without routes. If 0, routes without a host are used",
+	)
+
+	headerRulesPath = flag.String(
+		"header-rules",
+		"",
+		"read header rules from a `file`, one per line, before those given with -header-rule",
+	)
+
+	authPassphrase = flag.String(
+		"auth-passphrase",
+		"",
+		"require clients to prove they know a `passphrase` (default $"+authPassphraseEnv+")",
+	)
+	authToken = flag.Bool(
+		"auth-token",
+		false,
+		"require clients to prove they know a generated token, logged to be shared with the room id",
+	)
+	verifySAS = flag.Bool(
+		"verify-sas",
+		false,
+		"serve clients once the short authentication string shown by their page is typed here, to detect a MITM",
+	)
+	approveClients = flag.Bool(
+		"approve-clients",
+		false,
+		"prompt to approve, deny, or approve all new clients before serving them",
 	)
 
+	cookieMode = flag.String(
+		"cookie-mode",
+		tunnel.CookieModePerClient,
+		"how cookies are kept: per-client, shared by all clients, or passthrough to clients",
+	)
+	cookieStorePath = flag.String(
+		"cookie-store",
+		"",
+		"save cookie jars, encrypted, in a `directory`, so they survive restarts",
+	)
+	cookieStoreKey = flag.String(
+		"cookie-store-key",
+		"",
+		"`key` to encrypt saved cookie jars with (default $"+cookieStoreKeyEnv+")",
+	)
+
+	udpIdleTimeout = flag.Duration(
+		"udp-idle-timeout",
+		time.Minute,
+		"close UDP flows after this long without datagrams in either direction",
+	)
+
+	routeSpecs      stringsFlag
+	hostAliases     stringsFlag
+	headerRuleSpecs stringsFlag
+	tcpAllow        stringsFlag
+	udpAllow        stringsFlag
+
 	defaultWebrtcConfig = webrtc.Configuration{
 		ICEServers: []webrtc.ICEServer{{URLs: []string{"stun:stun.l.google.com:19302"}}},
 	}
 )
 
+// authPassphraseEnv is the environment variable the auth passphrase is read from if it isn't given with a flag, so it
+// doesn't show up in the process list.
+const authPassphraseEnv = "WEB_P2P_TUNNEL_AUTH_PASSPHRASE"
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "cookies" {
+		cookiesCommand(os.Args[2:])
+		return
+	}
+
+	flag.Var(
+		&routeSpecs,
+		"route",
+		"proxy requests under a path prefix to a target. A `route` is [host]prefix=target[,option...] (repeatable)",
+	)
+	flag.Var(&hostAliases, "host-alias", "route requests for a host like another. An `alias` is host=vhost (repeatable)")
+	flag.Var(
+		&headerRuleSpecs,
+		"header-rule",
+		"rewrite a request or response header. A `rule` is like \"response set Cache-Control no-store\" (repeatable)",
+	)
+	flag.Var(&tcpAllow, "tcp-allow", "allow clients to open TCP connections to `host:port` (repeatable)")
+	flag.Var(&udpAllow, "udp-allow", "allow clients to send UDP datagrams to `host:port` (repeatable)")
 	flag.Parse()
 
 	signalingServerURL, err := url.Parse(*signalingServerURLStr)
@@ -42,24 +177,214 @@ func main() {
 		log.Fatal(err)
 	}
 
-	tunnelTargetURL, err := url.Parse(*tunnelTargetURLStr)
+	defaultRoute := tunnel.Route{
+		ChangeHostHeader:   *changeHostHeader,
+		ChangeOriginHeader: *changeOriginHeader,
+		RewriteURLs:        *rewriteURLs,
+		TLS: tunnel.TLSOptions{
+			CAFile:             *tlsCA,
+			InsecureSkipVerify: *tlsInsecureSkipVerify,
+			ServerName:         *tlsServerName,
+			CertFile:           *tlsCert,
+			KeyFile:            *tlsKey,
+		},
+	}
+
+	if *rewriteURLs != "" && *rewriteURLs != tunnel.RewriteURLsRelative && *rewriteURLs != tunnel.RewriteURLsOrigin {
+		log.Fatal("rewrite-urls must be relative or origin")
+	}
+
+	var routes []tunnel.Route
+	if *tunnelTargetURLStr != "" {
+		tunnelTargetURL, err := url.Parse(*tunnelTargetURLStr)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		route := defaultRoute
+		route.Prefix = "/"
+		route.Target = tunnelTargetURL
+		routes = append(routes, route)
+	}
+	if *servePath != "" {
+		route, err := tunnel.ParseRoute("/=file:"+*servePath, defaultRoute)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		routes = append(routes, route)
+	}
+	for _, spec := range routeSpecs {
+		route, err := tunnel.ParseRoute(spec, defaultRoute)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		routes = append(routes, route)
+	}
+	if len(routes) == 0 {
+		log.Fatal("tunnel-target-url, serve, or route is required")
+	}
+
+	aliases := make(map[string]string, len(hostAliases))
+	for _, alias := range hostAliases {
+		host, vhost, ok := strings.Cut(alias, "=")
+		if !ok {
+			log.Fatalf("host alias %q: expected host=vhost", alias)
+		}
+
+		aliases[host] = vhost
+	}
+
+	if *unknownHostStatus != 0 &&
+		*unknownHostStatus != http.StatusMisdirectedRequest &&
+		*unknownHostStatus != http.StatusNotFound {
+		log.Fatal("unknown-host-status must be 0, 421, or 404")
+	}
+
+	tunnelRoutes, err := tunnel.NewRoutes(routes, aliases, *unknownHostStatus)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	var headerRules tunnel.HeaderRules
+	if *headerRulesPath != "" {
+		f, err := os.Open(*headerRulesPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		rules, err := tunnel.ParseHeaderRules(f)
+		f.Close()
+		if err != nil {
+			log.Fatalf("%s: %v", *headerRulesPath, err)
+		}
+
+		headerRules = append(headerRules, rules...)
+	}
+	for _, spec := range headerRuleSpecs {
+		rule, err := tunnel.ParseHeaderRule(spec)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		headerRules = append(headerRules, rule)
+	}
+
+	passphrase := *authPassphrase
+	if passphrase == "" {
+		passphrase = os.Getenv(authPassphraseEnv)
+	}
+
+	var auth *tunnel.Auth
+	var token string
+	switch {
+	case passphrase != "" && *authToken:
+		log.Fatal("auth-passphrase and auth-token can't be used together")
+	case passphrase != "":
+		auth, err = tunnel.NewAuth(passphrase)
+		if err != nil {
+			log.Fatal(err)
+		}
+	case *authToken:
+		token, err = tunnel.NewAuthToken()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		auth, err = tunnel.NewAuth(token)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var cookieStore *tunnel.CookieStore
+	switch *cookieMode {
+	case tunnel.CookieModePerClient, tunnel.CookieModeShared:
+		if *cookieStorePath != "" {
+			cookieStore, err = tunnel.NewCookieStore(*cookieStorePath, cookieStoreKeyOrEnv(*cookieStoreKey))
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+	case tunnel.CookieModePassthrough:
+		if *cookieStorePath != "" {
+			log.Fatal("cookie-store can't be used with cookie-mode passthrough")
+		}
+	default:
+		log.Fatal("cookie-mode must be per-client, shared, or passthrough")
+	}
+
+	if *bufferedAmountLowThreshold > *bufferedAmountHighThreshold {
+		log.Fatal("buffered-amount-low-threshold must not exceed buffered-amount-high-threshold")
+	}
+	flowControl := tunnel.FlowControl{
+		HighThreshold: *bufferedAmountHighThreshold,
+		LowThreshold:  *bufferedAmountLowThreshold,
+	}
+
+	tcpAllowlist, err := tunnel.NewAllowlist(tcpAllow)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	udpAllowlist, err := tunnel.NewAllowlist(udpAllow)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *udpIdleTimeout <= 0 {
+		log.Fatal("udp-idle-timeout must be positive")
+	}
+
 	roomID, err := signaling.CreateRoom(signalingServerURL)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	log.Printf("Created room %s", roomID)
+	if token != "" {
+		log.Printf("Clients must authenticate with token %s", token)
+	}
 
 	sc := signaling.NewClient(roomID, signalingServerURL)
 	if err := sc.Connect(); err != nil {
 		log.Fatal(err)
 	}
 
-	th := tunnel.NewHub(tunnelTargetURL, *changeHostHeader, *changeOriginHeader, defaultWebrtcConfig)
+	th := tunnel.NewHub(
+		tunnelRoutes,
+		headerRules,
+		auth,
+		*verifySAS,
+		*cookieMode,
+		cookieStore,
+		defaultWebrtcConfig,
+		flowControl,
+		*httpMux,
+	)
+
+	tcpHandler := &tunnel.TCPHandler{Allowlist: tcpAllowlist, FlowControl: flowControl}
+	th.Handle("tcp", tcpHandler)
+	th.HandlePrefix("tcp:", tcpHandler)
+
+	udpHandler := &tunnel.UDPHandler{Allowlist: udpAllowlist, IdleTimeout: *udpIdleTimeout, FlowControl: flowControl}
+	th.HandlePrefix("udp:", udpHandler)
+
+	if *verifySAS || *approveClients {
+		var confirmSAS func(string) bool
+		if *verifySAS {
+			log.Println("Type the short authentication string shown by a client's page and press enter to confirm it")
+
+			confirmSAS = th.ConfirmSAS
+		}
+
+		term := newTerminal(confirmSAS)
+		if *approveClients {
+			th.SetClientApprover(term.approveClient)
+		}
+
+		go term.run()
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	g, ctx := errgroup.WithContext(ctx)
@@ -91,3 +416,15 @@ func main() {
 		log.Fatal(err)
 	}
 }
+
+// stringsFlag is a flag that may be repeated.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/andrewmthomas87/web-p2p-tunnel/internal/tunnel"
+)
+
+const approvePrompt = "Approve? [y]es, [n]o, or approve [a]ll: "
+
+// terminal reads the operator's input from stdin. Lines of six digits are confirmed as short authentication strings
+// with confirmSAS, if it's set, even while a prompt is pending. Other lines answer the pending prompt, if there is one.
+// Once stdin closes, prompts are denied.
+type terminal struct {
+	confirmSAS func(sas string) bool
+
+	prompts chan *approvalPrompt
+}
+
+type approvalPrompt struct {
+	ctx      context.Context
+	client   tunnel.ClientApproval
+	approved chan bool
+}
+
+func newTerminal(confirmSAS func(sas string) bool) *terminal {
+	return &terminal{
+		confirmSAS: confirmSAS,
+		prompts:    make(chan *approvalPrompt),
+	}
+}
+
+// approveClient prompts the operator to approve, deny, or approve all clients. It's a tunnel.ClientApprover.
+func (t *terminal) approveClient(ctx context.Context, client tunnel.ClientApproval) bool {
+	p := &approvalPrompt{ctx: ctx, client: client, approved: make(chan bool, 1)}
+	t.prompts <- p
+
+	return <-p.approved
+}
+
+// run reads lines and shows prompts, one at a time, in the order they're requested.
+func (t *terminal) run() {
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			lines <- strings.TrimSpace(scanner.Text())
+		}
+	}()
+
+	var approveAll, closed bool
+	var pending []*approvalPrompt
+
+	// next shows the next pending prompt, skipping those of clients that disconnected while waiting.
+	next := func() {
+		for len(pending) > 0 && pending[0].ctx.Err() != nil {
+			pending[0].approved <- false
+			pending = pending[1:]
+		}
+		if len(pending) > 0 {
+			showApprovalPrompt(pending[0].client)
+		}
+	}
+	answer := func(approved bool) {
+		pending[0].approved <- approved
+		pending = pending[1:]
+		next()
+	}
+
+	for {
+		var done <-chan struct{}
+		if len(pending) > 0 {
+			done = pending[0].ctx.Done()
+		}
+
+		select {
+		case p := <-t.prompts:
+			if approveAll || closed {
+				p.approved <- approveAll
+				continue
+			}
+
+			pending = append(pending, p)
+			if len(pending) == 1 {
+				next()
+			}
+
+		case <-done:
+			fmt.Fprintf(os.Stderr, "\nClient %s disconnected\n", pending[0].client.ID)
+			answer(false)
+
+		case line, ok := <-lines:
+			if !ok {
+				// Nobody can answer prompts anymore, so they're denied rather than left waiting.
+				log.Println("Stdin closed. Clients that must be approved are denied.")
+				lines = nil
+				closed = true
+				for _, p := range pending {
+					p.approved <- false
+				}
+				pending = nil
+				continue
+			}
+			if line == "" {
+				continue
+			}
+
+			if t.confirmSAS != nil && looksLikeSAS(line) {
+				if !t.confirmSAS(line) {
+					log.Printf("No client has short authentication string %s", line)
+				}
+				if len(pending) > 0 {
+					fmt.Fprint(os.Stderr, approvePrompt)
+				}
+				continue
+			}
+			if len(pending) == 0 {
+				if t.confirmSAS != nil {
+					log.Printf("%q isn't a short authentication string, like 012 345", line)
+				}
+				continue
+			}
+
+			switch strings.ToLower(line) {
+			case "y", "yes":
+				answer(true)
+			case "n", "no":
+				answer(false)
+			case "a", "all":
+				approveAll = true
+				for _, p := range pending {
+					p.approved <- true
+				}
+				pending = nil
+			default:
+				fmt.Fprint(os.Stderr, approvePrompt)
+			}
+
+		}
+	}
+}
+
+// looksLikeSAS reports whether line is shaped like a short authentication string: six digits, maybe with spaces.
+func looksLikeSAS(line string) bool {
+	digits := strings.ReplaceAll(line, " ", "")
+	if len(digits) != 6 {
+		return false
+	}
+	for _, r := range digits {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+func showApprovalPrompt(client tunnel.ClientApproval) {
+	remoteAddr := client.RemoteAddr
+	if remoteAddr == "" {
+		remoteAddr = "unknown"
+	}
+
+	// The name and user agent are sent by the client, so they're quoted to keep control characters out of the
+	// terminal.
+	fmt.Fprintf(
+		os.Stderr,
+		"\nClient %s wants to connect\n  Name:       %q\n  User agent: %q\n  Address:    %s\n%s",
+		client.ID,
+		client.Name,
+		client.UserAgent,
+		remoteAddr,
+		approvePrompt,
+	)
+}
@@ -32,6 +32,8 @@ type Client struct {
 type Offer struct {
 	ClientID string
 	Data     webrtc.SessionDescription
+	// Auth is the HMAC of the offer's SDP that the client sent along with it to authenticate, if any.
+	Auth string
 }
 
 type Answer struct {
@@ -154,9 +156,17 @@ func (c *Client) readPump() {
 				return
 			}
 
+			var auth struct {
+				Auth string `json:"auth"`
+			}
+			if err := json.Unmarshal(message.Data, &auth); err != nil {
+				return
+			}
+
 			c.offers <- Offer{
 				ClientID: message.ClientID,
 				Data:     data,
+				Auth:     auth.Auth,
 			}
 
 		case "icecandidate":
@@ -0,0 +1,44 @@
+package tunnel
+
+import (
+	"net"
+	"strings"
+)
+
+// Allowlist is a set of host:port addresses that clients may reach.
+type Allowlist map[string]struct{}
+
+// NewAllowlist creates an allowlist from host:port addresses.
+func NewAllowlist(addrs []string) (Allowlist, error) {
+	a := make(Allowlist, len(addrs))
+	for _, addr := range addrs {
+		normalized, err := normalizeAddr(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		a[normalized] = struct{}{}
+	}
+
+	return a, nil
+}
+
+// Allows reports whether addr is allowed.
+func (a Allowlist) Allows(addr string) bool {
+	normalized, err := normalizeAddr(addr)
+	if err != nil {
+		return false
+	}
+
+	_, ok := a[normalized]
+	return ok
+}
+
+func normalizeAddr(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(strings.ToLower(host), port), nil
+}
@@ -0,0 +1,43 @@
+package tunnel
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+)
+
+// approvalHelloTimeout is how long an authenticated client's approval waits for its control hello, to show its name
+// and user agent, before it's requested without them.
+const approvalHelloTimeout = 5 * time.Second
+
+// ClientApproval describes a client waiting to be approved.
+type ClientApproval struct {
+	ID string
+	// Name and UserAgent are sent by the client in its control hello, if it sent one in time. They may be empty, and
+	// aren't verified.
+	Name      string
+	UserAgent string
+	// RemoteAddr is the address of the client's ICE candidate that the connection uses, if known.
+	RemoteAddr string
+}
+
+// ClientApprover decides whether a client may use the tunnel. It may block, like to prompt the operator. ctx is
+// canceled if the client disconnects first.
+type ClientApprover func(ctx context.Context, client ClientApproval) bool
+
+// RemoteAddr returns the address of the client's ICE candidate that the connection uses, like "203.0.113.7:54321", or
+// "" if the connection isn't established.
+func (t *Tunnel) RemoteAddr() string {
+	sctp := t.pc.SCTP()
+	if sctp == nil {
+		return ""
+	}
+
+	pair, err := sctp.Transport().ICETransport().GetSelectedCandidatePair()
+	if err != nil || pair == nil {
+		return ""
+	}
+
+	return net.JoinHostPort(pair.Remote.Address, strconv.Itoa(int(pair.Remote.Port)))
+}
@@ -0,0 +1,135 @@
+package tunnel
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// authFreeFailures is the number of failed attempts a client may make before it must back off. It then waits
+	// authBaseBackoff before it may try again, doubled for each further failure, up to authMaxBackoff. Failures are
+	// forgotten authMaxBackoff after the last one.
+	authFreeFailures = 3
+	authBaseBackoff  = time.Second
+	authMaxBackoff   = 5 * time.Minute
+
+	// authTimeout is how long a client has to authenticate before its tunnel is closed.
+	authTimeout = 30 * time.Second
+)
+
+var (
+	errAuthFailed      = errors.New("authentication failed")
+	errAuthRateLimited = errors.New("too many failed authentication attempts, try again later")
+)
+
+// Auth authenticates clients by their knowledge of a secret, like a passphrase or a token shared with the tunnel's
+// link. A client proves it with the HMAC-SHA256, keyed with the secret, of its offer's SDP or of a challenge sent over
+// the control channel. Failed attempts are limited per remote address, or per client if its address isn't known yet,
+// with backoff, so that a client guessing the secret can't keep others from authenticating.
+type Auth struct {
+	log *log.Logger
+
+	secret []byte
+
+	mu       sync.Mutex
+	failures map[string]*authFailures
+}
+
+// authFailures are the recent failed attempts of a remote address or client.
+type authFailures struct {
+	count int
+	last  time.Time
+}
+
+// retryAt returns when the next attempt may be made.
+func (f *authFailures) retryAt() time.Time {
+	if f.count < authFreeFailures {
+		return f.last
+	}
+
+	backoff := authMaxBackoff
+	if n := f.count - authFreeFailures; n < 16 {
+		backoff = min(authBaseBackoff<<n, authMaxBackoff)
+	}
+
+	return f.last.Add(backoff)
+}
+
+func NewAuth(secret string) (*Auth, error) {
+	if secret == "" {
+		return nil, errors.New("auth requires a secret")
+	}
+
+	return &Auth{
+		log:      log.New(os.Stderr, "[Auth] ", log.LstdFlags),
+		secret:   []byte(secret),
+		failures: make(map[string]*authFailures),
+	}, nil
+}
+
+// NewAuthToken generates a random token to use as a secret.
+func NewAuthToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// verify checks that mac is the base64-encoded HMAC of message, sent by the client clientID with method, like
+// "offer". Failures are counted against key, the client's remote address or ID.
+func (a *Auth) verify(key, clientID, method, message, mac string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	for k, f := range a.failures {
+		if now.Sub(f.last) >= authMaxBackoff {
+			delete(a.failures, k)
+		}
+	}
+
+	f := a.failures[key]
+	if f != nil && now.Before(f.retryAt()) {
+		a.log.Printf("Rejected %s of client %s. Too many failed attempts from %s.", method, clientID[:6], key)
+		return errAuthRateLimited
+	}
+
+	h := hmac.New(sha256.New, a.secret)
+	h.Write([]byte(message))
+
+	got, err := base64.StdEncoding.DecodeString(mac)
+	if err != nil || !hmac.Equal(got, h.Sum(nil)) {
+		if f == nil {
+			f = &authFailures{}
+			a.failures[key] = f
+		}
+		f.count++
+		f.last = now
+
+		a.log.Printf("Client %s failed to authenticate with %s from %s", clientID[:6], method, key)
+		return errAuthFailed
+	}
+
+	delete(a.failures, key)
+
+	return nil
+}
+
+// newAuthChallenge generates a random challenge for a client to authenticate with.
+func newAuthChallenge() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,61 @@
+package tunnel
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAuthBackoff(t *testing.T) {
+	auth, err := NewAuth("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := hmac.New(sha256.New, []byte("secret"))
+	h.Write([]byte("challenge"))
+	mac := base64.StdEncoding.EncodeToString(h.Sum(nil))
+
+	for i := 0; i < authFreeFailures; i++ {
+		if err := auth.verify("203.0.113.7", "attacker", "test", "challenge", "wrong"); !errors.Is(err, errAuthFailed) {
+			t.Fatalf("failure %d: got %v, want %v", i+1, err, errAuthFailed)
+		}
+	}
+
+	// The address backs off, even with the right secret, but other clients don't.
+	if err := auth.verify("203.0.113.7", "attacker", "test", "challenge", mac); !errors.Is(err, errAuthRateLimited) {
+		t.Errorf("got %v, want %v", err, errAuthRateLimited)
+	}
+	if err := auth.verify("198.51.100.1", "legitimate", "test", "challenge", mac); err != nil {
+		t.Errorf("other address: got %v", err)
+	}
+
+	// Once the backoff has passed, the address may try again, and a success forgets its failures.
+	auth.failures["203.0.113.7"].last = time.Now().Add(-authBaseBackoff)
+	if err := auth.verify("203.0.113.7", "attacker", "test", "challenge", mac); err != nil {
+		t.Errorf("after backoff: got %v", err)
+	}
+	if _, ok := auth.failures["203.0.113.7"]; ok {
+		t.Error("failures weren't forgotten after a success")
+	}
+}
+
+func TestAuthFailuresRetryAt(t *testing.T) {
+	last := time.Now()
+	for count, want := range map[int]time.Duration{
+		authFreeFailures - 1: 0,
+		authFreeFailures:     authBaseBackoff,
+		authFreeFailures + 1: 2 * authBaseBackoff,
+		authFreeFailures + 3: 8 * authBaseBackoff,
+		authFreeFailures + 9: authMaxBackoff,
+		1000:                 authMaxBackoff,
+	} {
+		f := &authFailures{count: count, last: last}
+		if got := f.retryAt().Sub(last); got != want {
+			t.Errorf("%d failures: got %s, want %s", count, got, want)
+		}
+	}
+}
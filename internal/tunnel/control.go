@@ -0,0 +1,349 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// ControlProtocolVersion is the version of the control protocol spoken over control data channels.
+//
+// Each message on a control data channel is a JSON controlMessage. The server sends hello and metadata messages when
+// the channel opens, and the client should send its own hello. Either side may send ping, which is answered by pong
+// with the same id and data. The server may send notice and goingAway messages at any time. The client may read and
+// write the tunnel's cookie jar with getCookies, setCookie, and deleteCookie, which are answered by cookies. If the
+// tunnel requires authentication, the server's hello has a challenge, and the client must send authenticate, answered
+// by authenticated, before any other messages. The client derives the short authentication string with the server by
+// sending sasCommit, answered by sasNonce, and then sasReveal. If the tunnel verifies short authentication strings,
+// the server sends sasConfirmed once the client's string is confirmed in the CLI. If clients must be approved, the
+// server sends approved once the client is, or goingAway if it isn't. Cookie messages are answered by errors until the
+// client is confirmed and approved. Unknown message types are answered by an error message with the same id.
+const ControlProtocolVersion = 1
+
+const controlGoingAwayTimeout = 500 * time.Millisecond
+
+type controlMessage struct {
+	ID   uint64          `json:"id,omitempty"`
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// controlMinClientKeyLength is the minimum length of the key a client may send in its hello. The key grants access to
+// the client's cookies, so it must be hard to guess.
+const controlMinClientKeyLength = 16
+
+type controlHello struct {
+	Version      int      `json:"version"`
+	Capabilities []string `json:"capabilities"`
+	// ClientKey is a secret the client keeps across connections, like in localStorage, to be recognized by. It's only
+	// sent by clients.
+	ClientKey string `json:"clientKey,omitempty"`
+	// Name and UserAgent describe the client to the operator, like when it's waiting to be approved. They're only sent
+	// by clients, and aren't verified.
+	Name      string `json:"name,omitempty"`
+	UserAgent string `json:"userAgent,omitempty"`
+	// AuthChallenge is the challenge to authenticate with, if the client must. It's only sent by servers.
+	AuthChallenge string `json:"authChallenge,omitempty"`
+}
+
+// controlPreAuthMessageTypes are the message types a client may send before authenticating.
+var controlPreAuthMessageTypes = map[string]bool{
+	"hello":        true,
+	"ping":         true,
+	"pong":         true,
+	"authenticate": true,
+}
+
+type controlAuthenticate struct {
+	// HMAC is the base64-encoded HMAC-SHA256 of the challenge, keyed with the tunnel's secret.
+	HMAC string `json:"hmac"`
+}
+
+// ControlMetadata describes the tunnel to clients.
+type ControlMetadata struct {
+	// Target is the target of the default virtual host's root route, if there is one.
+	Target string `json:"target"`
+	// Routes maps route virtual hosts and prefixes, like "app.localhost/api", to targets.
+	Routes        map[string]string `json:"routes"`
+	ServerVersion string            `json:"serverVersion"`
+}
+
+func newControlMetadata(routes *Routes) ControlMetadata {
+	m := ControlMetadata{
+		Routes:        make(map[string]string, len(routes.All())),
+		ServerVersion: serverVersion(),
+	}
+	for _, r := range routes.All() {
+		m.Routes[r.String()] = r.Target.Redacted()
+		if r.String() == "/" {
+			m.Target = r.Target.Redacted()
+		}
+	}
+
+	return m
+}
+
+type controlNotice struct {
+	Level   string `json:"level"`
+	Message string `json:"message"`
+}
+
+type controlGoingAway struct {
+	Reason string `json:"reason"`
+}
+
+type controlError struct {
+	Message string `json:"message"`
+}
+
+// ControlDataChannel speaks the control protocol with a client.
+type ControlDataChannel struct {
+	log *log.Logger
+
+	dc *webrtc.DataChannel
+
+	hello    controlHello
+	metadata ControlMetadata
+
+	mu            sync.Mutex
+	handlers      map[string]func(controlMessage) error
+	clientHello   *controlHello
+	onHello       func(controlHello)
+	verifyAuth    func(challenge, mac string) error
+	authenticated bool
+}
+
+func NewControlDataChannel(dc *webrtc.DataChannel, capabilities []string, metadata ControlMetadata) *ControlDataChannel {
+	c := &ControlDataChannel{
+		log: log.New(os.Stderr, fmt.Sprintf("[Control Data Channel %d] ", *dc.ID()), log.LstdFlags),
+		dc:  dc,
+		hello: controlHello{
+			Version:      ControlProtocolVersion,
+			Capabilities: capabilities,
+		},
+		metadata: metadata,
+	}
+
+	c.handlers = map[string]func(controlMessage) error{
+		"hello":        c.handleHello,
+		"ping":         c.handlePing,
+		"pong":         func(controlMessage) error { return nil },
+		"authenticate": c.handleAuthenticate,
+	}
+
+	dc.OnOpen(c.onOpen)
+	dc.OnMessage(c.onMessage)
+
+	return c
+}
+
+// Notice sends a notice to be shown to the user. level is info, warning, or error.
+func (c *ControlDataChannel) Notice(level, message string) error {
+	return c.send(0, "notice", controlNotice{Level: level, Message: message})
+}
+
+// GoingAway tells the client that the tunnel is closing, waiting briefly for the message to be sent.
+func (c *ControlDataChannel) GoingAway(reason string) error {
+	if err := c.send(0, "goingAway", controlGoingAway{Reason: reason}); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(controlGoingAwayTimeout)
+	for c.dc.BufferedAmount() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return nil
+}
+
+// ClientCapabilities returns the capabilities sent in the client's hello, or nil if it hasn't been received.
+func (c *ControlDataChannel) ClientCapabilities() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.clientHello == nil {
+		return nil
+	}
+
+	return c.clientHello.Capabilities
+}
+
+// receivedHello returns the client's hello, or false if it hasn't been received.
+func (c *ControlDataChannel) receivedHello() (controlHello, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.clientHello == nil {
+		return controlHello{}, false
+	}
+
+	return *c.clientHello, true
+}
+
+// handle registers handler for messages of a type. Handlers return errors to be answered by error messages.
+func (c *ControlDataChannel) handle(messageType string, handler func(controlMessage) error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.handlers[messageType] = handler
+}
+
+// setOnHello sets a function called with the client's hello when it's received.
+func (c *ControlDataChannel) setOnHello(f func(controlHello)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.onHello = f
+}
+
+// requireAuth makes the client authenticate before sending messages other than hello, ping, and pong. verify checks
+// the HMAC of the challenge sent in hello. It must be called before the channel opens.
+func (c *ControlDataChannel) requireAuth(verify func(challenge, mac string) error) error {
+	challenge, err := newAuthChallenge()
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.hello.AuthChallenge = challenge
+	c.verifyAuth = verify
+
+	return nil
+}
+
+func (c *ControlDataChannel) onOpen() {
+	if err := c.send(0, "hello", c.hello); err != nil {
+		c.log.Printf("Failed to send hello: %v", err)
+		return
+	}
+
+	if err := c.send(0, "metadata", c.metadata); err != nil {
+		c.log.Printf("Failed to send metadata: %v", err)
+		return
+	}
+}
+
+func (c *ControlDataChannel) onMessage(msg webrtc.DataChannelMessage) {
+	var message controlMessage
+	if err := json.Unmarshal(msg.Data, &message); err != nil {
+		c.log.Printf("Failed to parse message: %v", err)
+		return
+	}
+
+	c.mu.Lock()
+	handler, ok := c.handlers[message.Type]
+	authorized := c.verifyAuth == nil || c.authenticated || controlPreAuthMessageTypes[message.Type]
+	c.mu.Unlock()
+	if !authorized {
+		_ = c.send(message.ID, "error", controlError{Message: "not authenticated"})
+		return
+	}
+	if !ok {
+		c.log.Printf("Unknown message type %q", message.Type)
+
+		_ = c.send(message.ID, "error", controlError{Message: fmt.Sprintf("unknown message type %q", message.Type)})
+		return
+	}
+
+	if err := handler(message); err != nil {
+		c.log.Printf("Failed to handle %s: %v", message.Type, err)
+
+		_ = c.send(message.ID, "error", controlError{Message: err.Error()})
+		return
+	}
+}
+
+func (c *ControlDataChannel) handleHello(message controlMessage) error {
+	var hello controlHello
+	if err := json.Unmarshal(message.Data, &hello); err != nil {
+		return err
+	}
+
+	c.log.Printf("Client hello: version %d, capabilities %v", hello.Version, hello.Capabilities)
+
+	if hello.Version < 1 {
+		return fmt.Errorf("unsupported control protocol version %d", hello.Version)
+	}
+	if hello.Version > ControlProtocolVersion {
+		// The client is newer. It's expected to fall back to our version, as advertised in our hello.
+		c.log.Printf("Client is using a newer control protocol version. Speaking version %d.", ControlProtocolVersion)
+	}
+	if hello.ClientKey != "" && len(hello.ClientKey) < controlMinClientKeyLength {
+		return fmt.Errorf("clientKey must be at least %d characters", controlMinClientKeyLength)
+	}
+
+	c.mu.Lock()
+	c.clientHello = &hello
+	onHello := c.onHello
+	c.mu.Unlock()
+
+	if onHello != nil {
+		onHello(hello)
+	}
+
+	return nil
+}
+
+func (c *ControlDataChannel) handleAuthenticate(message controlMessage) error {
+	var auth controlAuthenticate
+	if err := json.Unmarshal(message.Data, &auth); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	verify := c.verifyAuth
+	authenticated := c.authenticated
+	c.mu.Unlock()
+
+	if verify != nil && !authenticated {
+		if err := verify(c.hello.AuthChallenge, auth.HMAC); err != nil {
+			return err
+		}
+
+		c.mu.Lock()
+		c.authenticated = true
+		c.mu.Unlock()
+	}
+
+	return c.send(message.ID, "authenticated", struct{}{})
+}
+
+func (c *ControlDataChannel) handlePing(message controlMessage) error {
+	return c.send(message.ID, "pong", message.Data)
+}
+
+func (c *ControlDataChannel) send(id uint64, messageType string, data any) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	message, err := json.Marshal(controlMessage{
+		ID:   id,
+		Type: messageType,
+		Data: b,
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.dc.SendText(string(message))
+}
+
+// serverVersion is the version of the running program.
+func serverVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+
+	return info.Main.Version
+}
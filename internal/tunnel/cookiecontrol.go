@@ -0,0 +1,163 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// scriptJar is a cookie jar that the client's pages may read and write, like with document.cookie.
+type scriptJar interface {
+	scriptCookies(u *url.URL) []StoredCookie
+	setScriptCookies(u *url.URL, cookies []*http.Cookie) error
+}
+
+type controlGetCookies struct {
+	URL string `json:"url"`
+}
+
+type controlSetCookie struct {
+	URL string `json:"url"`
+	// Cookie is a cookie as written to document.cookie or in a Set-Cookie header, like "theme=dark; Path=/".
+	Cookie string `json:"cookie"`
+}
+
+type controlDeleteCookie struct {
+	URL    string `json:"url"`
+	Name   string `json:"name"`
+	Domain string `json:"domain,omitempty"`
+	Path   string `json:"path,omitempty"`
+}
+
+type controlCookies struct {
+	Cookies []controlCookie `json:"cookies"`
+}
+
+type controlCookie struct {
+	Name     string     `json:"name"`
+	Value    string     `json:"value"`
+	Domain   string     `json:"domain,omitempty"`
+	Path     string     `json:"path,omitempty"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	Secure   bool       `json:"secure"`
+	SameSite string     `json:"sameSite,omitempty"`
+}
+
+// handleCookieMessages registers handlers for the cookie messages of c, which read and write jar. Each is answered by
+// a cookies message listing the cookies scripts may read for the message's URL. HttpOnly cookies are never listed,
+// set, or deleted. Messages are answered by errors while denied returns one, like until the client is approved.
+func handleCookieMessages(c *ControlDataChannel, jar http.CookieJar, denied func() error) {
+	sj, _ := jar.(scriptJar)
+
+	handler := func(handle func(data json.RawMessage) (*url.URL, error)) func(controlMessage) error {
+		return func(message controlMessage) error {
+			if sj == nil {
+				return errors.New("cookies aren't kept by the tunnel")
+			}
+			if err := denied(); err != nil {
+				return err
+			}
+
+			u, err := handle(message.Data)
+			if err != nil {
+				return err
+			}
+
+			return c.send(message.ID, "cookies", newControlCookies(sj.scriptCookies(u)))
+		}
+	}
+
+	c.handle("getCookies", handler(func(data json.RawMessage) (*url.URL, error) {
+		var req controlGetCookies
+		if err := json.Unmarshal(data, &req); err != nil {
+			return nil, err
+		}
+
+		return parseCookieURL(req.URL)
+	}))
+
+	c.handle("setCookie", handler(func(data json.RawMessage) (*url.URL, error) {
+		var req controlSetCookie
+		if err := json.Unmarshal(data, &req); err != nil {
+			return nil, err
+		}
+
+		u, err := parseCookieURL(req.URL)
+		if err != nil {
+			return nil, err
+		}
+
+		// Cookies are parsed like those of a response.
+		cookies := (&http.Response{Header: http.Header{"Set-Cookie": {req.Cookie}}}).Cookies()
+		if len(cookies) == 0 {
+			return nil, fmt.Errorf("invalid cookie %q", req.Cookie)
+		}
+
+		return u, sj.setScriptCookies(u, cookies)
+	}))
+
+	c.handle("deleteCookie", handler(func(data json.RawMessage) (*url.URL, error) {
+		var req controlDeleteCookie
+		if err := json.Unmarshal(data, &req); err != nil {
+			return nil, err
+		}
+
+		u, err := parseCookieURL(req.URL)
+		if err != nil {
+			return nil, err
+		}
+
+		// As with the Cookie Store API, the path defaults to "/".
+		path := req.Path
+		if path == "" {
+			path = "/"
+		}
+
+		cookie := &http.Cookie{Name: req.Name, Domain: req.Domain, Path: path, MaxAge: -1}
+		return u, sj.setScriptCookies(u, []*http.Cookie{cookie})
+	}))
+}
+
+func parseCookieURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("url %q isn't an absolute http url", s)
+	}
+
+	return u, nil
+}
+
+func newControlCookies(cookies []StoredCookie) controlCookies {
+	m := controlCookies{Cookies: make([]controlCookie, 0, len(cookies))}
+	for _, c := range cookies {
+		cc := controlCookie{
+			Name:   c.Name,
+			Value:  c.Value,
+			Domain: c.Domain,
+			Path:   c.Path,
+			Secure: c.Secure,
+		}
+		if !c.Expires.IsZero() {
+			expires := c.Expires
+			cc.Expires = &expires
+		}
+		switch c.SameSite {
+		case http.SameSiteLaxMode:
+			cc.SameSite = "lax"
+		case http.SameSiteStrictMode:
+			cc.SameSite = "strict"
+		case http.SameSiteNoneMode:
+			cc.SameSite = "none"
+		}
+
+		m.Cookies = append(m.Cookies, cc)
+	}
+
+	return m
+}
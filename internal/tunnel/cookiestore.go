@@ -0,0 +1,284 @@
+package tunnel
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	cookieStoreExt = ".jar"
+
+	// cookieStoreSaltFile is the name of the file, in a store's directory, of the salt its key is derived with.
+	cookieStoreSaltFile = "salt"
+	cookieStoreSaltSize = 16
+
+	// The scrypt parameters a store's key is derived with. N is 2^15, as recommended for interactive logins, since a
+	// key is derived once per run.
+	cookieStoreScryptN = 1 << 15
+	cookieStoreScryptR = 8
+	cookieStoreScryptP = 1
+
+	// SharedCookieJarID is the ID of the jar shared by all clients in CookieModeShared.
+	SharedCookieJarID = "shared"
+)
+
+// StoredCookie is a cookie in a CookieStore, along with the URL of the response that set it.
+type StoredCookie struct {
+	URL      string        `json:"url"`
+	Name     string        `json:"name"`
+	Value    string        `json:"value"`
+	Domain   string        `json:"domain,omitempty"`
+	Path     string        `json:"path,omitempty"`
+	Expires  time.Time     `json:"expires,omitempty"`
+	Secure   bool          `json:"secure,omitempty"`
+	HttpOnly bool          `json:"httpOnly,omitempty"`
+	SameSite http.SameSite `json:"sameSite,omitempty"`
+}
+
+func newStoredCookie(u string, c *http.Cookie, now time.Time) StoredCookie {
+	expires := c.Expires
+	if c.MaxAge > 0 {
+		expires = now.Add(time.Duration(c.MaxAge) * time.Second)
+	}
+
+	return StoredCookie{
+		URL:      u,
+		Name:     c.Name,
+		Value:    c.Value,
+		Domain:   c.Domain,
+		Path:     c.Path,
+		Expires:  expires,
+		Secure:   c.Secure,
+		HttpOnly: c.HttpOnly,
+		SameSite: c.SameSite,
+	}
+}
+
+// Expired reports whether the cookie has expired. Session cookies, without an expiry, never do.
+func (c StoredCookie) Expired(now time.Time) bool {
+	return !c.Expires.IsZero() && !c.Expires.After(now)
+}
+
+func (c StoredCookie) cookie() *http.Cookie {
+	return &http.Cookie{
+		Name:     c.Name,
+		Value:    c.Value,
+		Domain:   c.Domain,
+		Path:     c.Path,
+		Expires:  c.Expires,
+		Secure:   c.Secure,
+		HttpOnly: c.HttpOnly,
+		SameSite: c.SameSite,
+	}
+}
+
+// StoredJar describes a jar in a CookieStore.
+type StoredJar struct {
+	ID       string
+	Modified time.Time
+}
+
+// CookieStore stores cookie jars in a directory, one file per client, encrypted with AES-GCM. Jars are identified by
+// the hash of the client's key, so the keys themselves aren't stored.
+type CookieStore struct {
+	dir  string
+	aead cipher.AEAD
+}
+
+// NewCookieStore creates a store of jars in dir, which is created if it doesn't exist. Jars are encrypted with a key
+// derived from key with scrypt and a random salt, generated when the store is created and saved in dir.
+func NewCookieStore(dir, key string) (*CookieStore, error) {
+	if key == "" {
+		return nil, errors.New("cookie store requires a key")
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	salt, err := cookieStoreSalt(dir)
+	if err != nil {
+		return nil, fmt.Errorf("cookie store salt: %w", err)
+	}
+
+	derived, err := scrypt.Key([]byte(key), salt, cookieStoreScryptN, cookieStoreScryptR, cookieStoreScryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(derived)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CookieStore{dir: dir, aead: aead}, nil
+}
+
+// cookieStoreSalt reads the salt of the store in dir, generating it if the store is new.
+func cookieStoreSalt(dir string) ([]byte, error) {
+	path := filepath.Join(dir, cookieStoreSaltFile)
+
+	salt, err := os.ReadFile(path)
+	if err == nil {
+		if len(salt) != cookieStoreSaltSize {
+			return nil, fmt.Errorf("%s: expected %d bytes, got %d", path, cookieStoreSaltSize, len(salt))
+		}
+
+		return salt, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	salt = make([]byte, cookieStoreSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	// The salt is only written if it doesn't exist, so a store being created by another process keeps its salt.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if errors.Is(err, os.ErrExist) {
+		return cookieStoreSalt(dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(salt); err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+
+	return salt, nil
+}
+
+// ClientJarID returns the ID of the jar of the client with key clientKey.
+func ClientJarID(clientKey string) string {
+	sum := sha256.Sum256([]byte(clientKey))
+	return hex.EncodeToString(sum[:16])
+}
+
+// Load returns the unexpired cookies of the jar id. A jar that doesn't exist has no cookies.
+func (s *CookieStore) Load(id string) ([]StoredCookie, error) {
+	data, err := os.ReadFile(s.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	nonceSize := s.aead.NonceSize()
+	if len(data) < nonceSize {
+		return nil, fmt.Errorf("cookie jar %s: truncated", id)
+	}
+
+	plaintext, err := s.aead.Open(nil, data[:nonceSize], data[nonceSize:], []byte(id))
+	if err != nil {
+		return nil, fmt.Errorf("cookie jar %s: decryption failed, is the key right?", id)
+	}
+
+	var cookies []StoredCookie
+	if err := json.Unmarshal(plaintext, &cookies); err != nil {
+		return nil, fmt.Errorf("cookie jar %s: %w", id, err)
+	}
+
+	now := time.Now()
+	unexpired := cookies[:0]
+	for _, c := range cookies {
+		if !c.Expired(now) {
+			unexpired = append(unexpired, c)
+		}
+	}
+
+	return unexpired, nil
+}
+
+// Save replaces the cookies of the jar id.
+func (s *CookieStore) Save(id string, cookies []StoredCookie) error {
+	plaintext, err := json.Marshal(cookies)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	data := s.aead.Seal(nonce, nonce, plaintext, []byte(id))
+
+	// Write to a temporary file and rename it, so that a jar is never partially written.
+	f, err := os.CreateTemp(s.dir, id+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), s.path(id))
+}
+
+// List lists the jars in the store, most recently modified first.
+func (s *CookieStore) List() ([]StoredJar, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var jars []StoredJar
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), cookieStoreExt)
+		if !ok || !entry.Type().IsRegular() {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		jars = append(jars, StoredJar{ID: id, Modified: info.ModTime()})
+	}
+	sort.Slice(jars, func(i, j int) bool {
+		return jars[i].Modified.After(jars[j].Modified)
+	})
+
+	return jars, nil
+}
+
+// Delete deletes the jar id.
+func (s *CookieStore) Delete(id string) error {
+	return os.Remove(s.path(id))
+}
+
+func (s *CookieStore) path(id string) string {
+	return filepath.Join(s.dir, filepath.Base(id)+cookieStoreExt)
+}
@@ -0,0 +1,71 @@
+package tunnel
+
+import (
+	"io"
+	"sync"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// FlowControl configures backpressure for data channel writers. Writers block when the data channel's buffered amount
+// exceeds HighThreshold and resume when it falls to LowThreshold.
+type FlowControl struct {
+	HighThreshold uint64
+	LowThreshold  uint64
+}
+
+var DefaultFlowControl = FlowControl{
+	HighThreshold: 1024 * 1024,
+	LowThreshold:  256 * 1024,
+}
+
+type flowController struct {
+	dc *webrtc.DataChannel
+
+	highThreshold uint64
+
+	low       chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newFlowController(dc *webrtc.DataChannel, fc FlowControl) *flowController {
+	f := &flowController{
+		dc:            dc,
+		highThreshold: fc.HighThreshold,
+		low:           make(chan struct{}, 1),
+		done:          make(chan struct{}),
+	}
+
+	dc.SetBufferedAmountLowThreshold(fc.LowThreshold)
+	dc.OnBufferedAmountLow(f.onBufferedAmountLow)
+
+	return f
+}
+
+// Send sends data, first blocking while the buffered amount exceeds the high threshold.
+func (f *flowController) Send(data []byte) error {
+	for f.dc.BufferedAmount() > f.highThreshold {
+		select {
+		case <-f.low:
+		case <-f.done:
+			return io.ErrClosedPipe
+		}
+	}
+
+	return f.dc.Send(data)
+}
+
+// Close unblocks pending and future sends. It must be called when the data channel closes.
+func (f *flowController) Close() {
+	f.closeOnce.Do(func() {
+		close(f.done)
+	})
+}
+
+func (f *flowController) onBufferedAmountLow() {
+	select {
+	case f.low <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,121 @@
+package tunnel
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// ClientInfo describes the client of a tunnel.
+type ClientInfo struct {
+	ID string
+	// Jar is the tunnel's cookie jar.
+	Jar http.CookieJar
+}
+
+// DataChannelHandler handles data channels opened by clients. HandleDataChannel is called as soon as a data channel
+// is opened, before any messages are received. It must register the data channel's callbacks before returning and
+// must not block. ctx is canceled when the tunnel closes.
+type DataChannelHandler interface {
+	HandleDataChannel(ctx context.Context, dc *webrtc.DataChannel, client ClientInfo)
+}
+
+// DataChannelHandlerFunc is an adapter to use a function as a DataChannelHandler.
+type DataChannelHandlerFunc func(ctx context.Context, dc *webrtc.DataChannel, client ClientInfo)
+
+func (f DataChannelHandlerFunc) HandleDataChannel(ctx context.Context, dc *webrtc.DataChannel, client ClientInfo) {
+	f(ctx, dc, client)
+}
+
+// DataChannelMux dispatches data channels to handlers by label. A handler registered for an exact label takes
+// precedence over handlers registered for label prefixes, and longer prefixes take precedence over shorter ones. Data
+// channels without a handler are closed.
+type DataChannelMux struct {
+	log *log.Logger
+
+	mu       sync.RWMutex
+	labels   map[string]DataChannelHandler
+	prefixes map[string]DataChannelHandler
+}
+
+func NewDataChannelMux() *DataChannelMux {
+	return &DataChannelMux{
+		log:      log.New(os.Stderr, "[Data Channel Mux] ", log.LstdFlags),
+		labels:   make(map[string]DataChannelHandler),
+		prefixes: make(map[string]DataChannelHandler),
+	}
+}
+
+// Handle registers handler for data channels labeled label.
+func (m *DataChannelMux) Handle(label string, handler DataChannelHandler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.labels[label] = handler
+}
+
+// HandlePrefix registers handler for data channels with labels starting with prefix.
+func (m *DataChannelMux) HandlePrefix(prefix string, handler DataChannelHandler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.prefixes[prefix] = handler
+}
+
+// Labels returns the registered labels, sorted. Prefixes are suffixed with "*".
+func (m *DataChannelMux) Labels() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	labels := make([]string, 0, len(m.labels)+len(m.prefixes))
+	for label := range m.labels {
+		labels = append(labels, label)
+	}
+	for prefix := range m.prefixes {
+		labels = append(labels, prefix+"*")
+	}
+	sort.Strings(labels)
+
+	return labels
+}
+
+func (m *DataChannelMux) HandleDataChannel(ctx context.Context, dc *webrtc.DataChannel, client ClientInfo) {
+	handler := m.handler(dc.Label())
+	if handler == nil {
+		m.log.Printf("Closing data channel %q of client %s. No handler for label.", dc.Label(), client.ID[:6])
+
+		// Closing the data channel before it opens doesn't close it for the client.
+		dc.OnOpen(func() {
+			_ = dc.Close()
+		})
+		return
+	}
+
+	handler.HandleDataChannel(ctx, dc, client)
+}
+
+func (m *DataChannelMux) handler(label string) DataChannelHandler {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if handler, ok := m.labels[label]; ok {
+		return handler
+	}
+
+	var match string
+	var handler DataChannelHandler
+	for prefix, h := range m.prefixes {
+		if strings.HasPrefix(label, prefix) && (handler == nil || len(prefix) > len(match)) {
+			match = prefix
+			handler = h
+		}
+	}
+
+	return handler
+}
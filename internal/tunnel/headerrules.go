@@ -0,0 +1,361 @@
+package tunnel
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Header rule actions.
+const (
+	HeaderAdd     = "add"
+	HeaderSet     = "set"
+	HeaderRemove  = "remove"
+	HeaderReplace = "replace"
+)
+
+// HeaderRule rewrites a header of proxied requests or of responses.
+type HeaderRule struct {
+	// Response applies the rule to responses instead of requests.
+	Response bool
+	// Action is HeaderAdd, HeaderSet, HeaderRemove, or HeaderReplace.
+	Action string
+	// Name is the header's name. For remove and replace rules, a name ending with "*", like "Sec-Fetch-*", matches
+	// every header starting with the rest of the name.
+	Name string
+	// Value is the value of add and set rules, and the replacement of replace rules. Replacements may refer to
+	// submatches of Pattern, like "$1".
+	Value string
+	// Pattern is the regular expression replaced in each value by replace rules.
+	Pattern *regexp.Regexp
+
+	// Path scopes the rule to requests with paths under a prefix, like "/api".
+	Path string
+	// Methods scopes the rule to requests with these methods.
+	Methods []string
+}
+
+// ParseHeaderRule parses a rule like "response set Cache-Control no-store path=/api method=GET,HEAD". The direction,
+// request or response, is followed by the action and its arguments:
+//
+//	add <name> <value>
+//	set <name> <value>
+//	remove <name>
+//	replace <name> <pattern> <replacement>
+//
+// The rule may be scoped with path=<prefix> and method=<methods>. Arguments containing spaces or quotes are written as
+// Go string literals, like "Bearer token".
+func ParseHeaderRule(s string) (HeaderRule, error) {
+	fields, err := splitHeaderRuleFields(s)
+	if err != nil {
+		return HeaderRule{}, fmt.Errorf("header rule %q: %w", s, err)
+	}
+
+	rule, err := parseHeaderRuleFields(fields)
+	if err != nil {
+		return HeaderRule{}, fmt.Errorf("header rule %q: %w", s, err)
+	}
+
+	return rule, nil
+}
+
+// ParseHeaderRules parses rules from r, one per line. Blank lines and lines starting with "#" are ignored.
+func ParseHeaderRules(r io.Reader) ([]HeaderRule, error) {
+	var rules []HeaderRule
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		rule, err := ParseHeaderRule(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+func parseHeaderRuleFields(fields []string) (HeaderRule, error) {
+	if len(fields) < 3 {
+		return HeaderRule{}, errors.New("expected direction, action, and header name")
+	}
+
+	var rule HeaderRule
+	switch fields[0] {
+	case "request":
+	case "response":
+		rule.Response = true
+	default:
+		return HeaderRule{}, fmt.Errorf("unknown direction %q", fields[0])
+	}
+
+	rule.Action = fields[1]
+	rule.Name = fields[2]
+
+	var args int
+	switch rule.Action {
+	case HeaderAdd, HeaderSet:
+		args = 1
+	case HeaderRemove:
+		args = 0
+	case HeaderReplace:
+		args = 2
+	default:
+		return HeaderRule{}, fmt.Errorf("unknown action %q", rule.Action)
+	}
+
+	wildcard := strings.HasSuffix(rule.Name, "*")
+	if wildcard && (rule.Action == HeaderAdd || rule.Action == HeaderSet) {
+		return HeaderRule{}, fmt.Errorf("%s rules can't have wildcard names", rule.Action)
+	}
+	if name := strings.TrimSuffix(rule.Name, "*"); name == "" && !wildcard || strings.ContainsFunc(name, isNotToken) {
+		return HeaderRule{}, fmt.Errorf("invalid header name %q", rule.Name)
+	}
+	rule.Name = http.CanonicalHeaderKey(rule.Name)
+
+	rest := fields[3:]
+	if len(rest) < args {
+		return HeaderRule{}, fmt.Errorf("%s rules take %d arguments after the header name", rule.Action, args)
+	}
+
+	switch rule.Action {
+	case HeaderAdd, HeaderSet:
+		rule.Value = rest[0]
+
+	case HeaderReplace:
+		pattern, err := regexp.Compile(rest[0])
+		if err != nil {
+			return HeaderRule{}, err
+		}
+
+		rule.Pattern = pattern
+		rule.Value = rest[1]
+
+	}
+
+	for _, field := range rest[args:] {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return HeaderRule{}, fmt.Errorf("unexpected argument %q", field)
+		}
+
+		switch key {
+		case "path":
+			path, err := normalizePrefix(value)
+			if err != nil {
+				return HeaderRule{}, err
+			}
+
+			rule.Path = path
+
+		case "method":
+			for _, method := range strings.Split(value, ",") {
+				rule.Methods = append(rule.Methods, strings.ToUpper(strings.TrimSpace(method)))
+			}
+
+		default:
+			return HeaderRule{}, fmt.Errorf("unknown scope %q", key)
+		}
+	}
+
+	return rule, nil
+}
+
+// splitHeaderRuleFields splits s into fields separated by spaces. Fields starting with a double quote are Go string
+// literals.
+func splitHeaderRuleFields(s string) ([]string, error) {
+	var fields []string
+
+	for {
+		s = strings.TrimLeftFunc(s, unicode.IsSpace)
+		if s == "" {
+			return fields, nil
+		}
+
+		if s[0] != '"' {
+			end := strings.IndexFunc(s, unicode.IsSpace)
+			if end == -1 {
+				end = len(s)
+			}
+
+			fields = append(fields, s[:end])
+			s = s[end:]
+			continue
+		}
+
+		end := 1
+		for end < len(s) && s[end] != '"' {
+			if s[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(s) {
+			return nil, errors.New("unterminated quoted string")
+		}
+
+		field, err := strconv.Unquote(s[:end+1])
+		if err != nil {
+			return nil, err
+		}
+
+		fields = append(fields, field)
+		s = s[end+1:]
+	}
+}
+
+func isNotToken(r rune) bool {
+	return r > unicode.MaxASCII || unicode.IsSpace(r) || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, r)
+}
+
+// applies reports whether the rule applies to req.
+func (rule HeaderRule) applies(req *http.Request) bool {
+	if rule.Path != "" && !hasPathPrefix(req.URL.Path, rule.Path) {
+		return false
+	}
+
+	if len(rule.Methods) == 0 {
+		return true
+	}
+	for _, method := range rule.Methods {
+		if method == req.Method {
+			return true
+		}
+	}
+
+	return false
+}
+
+// apply rewrites header.
+func (rule HeaderRule) apply(header http.Header) {
+	switch rule.Action {
+	case HeaderAdd:
+		header.Add(rule.Name, rule.Value)
+
+	case HeaderSet:
+		header.Set(rule.Name, rule.Value)
+
+	case HeaderRemove:
+		for _, name := range rule.names(header) {
+			header.Del(name)
+		}
+
+	case HeaderReplace:
+		for _, name := range rule.names(header) {
+			values := header[name]
+			for i, value := range values {
+				values[i] = rule.Pattern.ReplaceAllString(value, rule.Value)
+			}
+		}
+
+	}
+}
+
+// names returns the names of the headers in header matched by the rule's name.
+func (rule HeaderRule) names(header http.Header) []string {
+	prefix, wildcard := strings.CutSuffix(rule.Name, "*")
+	if !wildcard {
+		return []string{rule.Name}
+	}
+
+	var names []string
+	for name := range header {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// HeaderRules are header rules applied in order.
+type HeaderRules []HeaderRule
+
+// rewriteRequest applies the request rules that apply to req to header, the header of the request to the target.
+func (rules HeaderRules) rewriteRequest(req *http.Request, header http.Header) {
+	for _, rule := range rules {
+		if !rule.Response && rule.applies(req) {
+			rule.apply(header)
+		}
+	}
+}
+
+// rewriteResponse applies the response rules that apply to req to the header of its response.
+func (rules HeaderRules) rewriteResponse(req *http.Request, header http.Header) {
+	for _, rule := range rules {
+		if rule.Response && rule.applies(req) {
+			rule.apply(header)
+		}
+	}
+}
+
+// hasResponseRules reports whether any rule applies to responses.
+func (rules HeaderRules) hasResponseRules() bool {
+	for _, rule := range rules {
+		if rule.Response {
+			return true
+		}
+	}
+
+	return false
+}
+
+// headerRewritingResponseWriter applies response header rules when the header is written.
+type headerRewritingResponseWriter struct {
+	http.ResponseWriter
+
+	req     *http.Request
+	rules   HeaderRules
+	rewrote bool
+}
+
+func (w *headerRewritingResponseWriter) WriteHeader(code int) {
+	// Informational responses don't end the header.
+	if !w.rewrote && (code < 100 || code > 199 || code == http.StatusSwitchingProtocols) {
+		w.rewrote = true
+		w.rules.rewriteResponse(w.req, w.Header())
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *headerRewritingResponseWriter) Write(p []byte) (int, error) {
+	if !w.rewrote {
+		// The header is written before the wrapped writer sees the body, so the content type is sniffed here, as
+		// net/http would, for the rules to see it.
+		if _, ok := w.Header()["Content-Type"]; !ok && w.Header().Get("Transfer-Encoding") == "" && len(p) > 0 {
+			w.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *headerRewritingResponseWriter) Flush() {
+	if !w.rewrote {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *headerRewritingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
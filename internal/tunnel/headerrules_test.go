@@ -0,0 +1,27 @@
+package tunnel
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHeaderRewritingResponseWriterSniffs(t *testing.T) {
+	rule, err := ParseHeaderRule("response set Cache-Control no-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := &headerRewritingResponseWriter{ResponseWriter: rec, req: req, rules: HeaderRules{rule}}
+	_, _ = io.WriteString(w, "<!doctype html><p>hello")
+
+	if got := rec.Header().Get("Content-Type"); got != "text/html; charset=utf-8" {
+		t.Errorf("got Content-Type %q, want it sniffed", got)
+	}
+	if got := rec.Header().Get("Cache-Control"); got != "no-store" {
+		t.Errorf("got Cache-Control %q, want the rule applied", got)
+	}
+}
@@ -2,34 +2,52 @@ package tunnel
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/pion/webrtc/v4"
 )
 
 const mtu = 16*1024 - 1
 
+var errExchangeDone = errors.New("exchange done")
+
 type HTTPDataChannel struct {
 	log *log.Logger
 
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+
 	client *http.Client
 	dc     *webrtc.DataChannel
+	fc     *flowController
 
 	r *io.PipeReader
 	w *io.PipeWriter
 }
 
-func NewHTTPDataChannel(client *http.Client, dc *webrtc.DataChannel) *HTTPDataChannel {
+func NewHTTPDataChannel(
+	ctx context.Context,
+	client *http.Client,
+	dc *webrtc.DataChannel,
+	flowControl FlowControl,
+) *HTTPDataChannel {
 	r, w := io.Pipe()
+	ctx, cancel := context.WithCancelCause(ctx)
 
 	h := &HTTPDataChannel{
 		log:    log.New(os.Stderr, fmt.Sprintf("[HTTP Data Channel %d] ", *dc.ID()), log.LstdFlags),
+		ctx:    ctx,
+		cancel: cancel,
 		client: client,
 		dc:     dc,
+		fc:     newFlowController(dc, flowControl),
 		r:      r,
 		w:      w,
 	}
@@ -40,33 +58,18 @@ func NewHTTPDataChannel(client *http.Client, dc *webrtc.DataChannel) *HTTPDataCh
 	return h
 }
 
+// Run reads a request from the data channel, proxies it, and writes the response to the data channel. The request is
+// proxied as soon as its header is read. Its body is streamed from the data channel as fragments arrive.
 func (h *HTTPDataChannel) Run() {
-	req, err := http.ReadRequest(bufio.NewReader(h.r))
-	if err != nil {
-		h.log.Printf("Failed to read request: %v", err)
+	// Once the exchange is over, fragments still arriving are discarded instead of blocking the data channel.
+	defer h.r.CloseWithError(errExchangeDone)
 
+	if err := proxyHTTP(h.ctx, h.log, h.client, h.r, h); err != nil {
 		_ = h.dc.Close()
 		return
 	}
-	req.RequestURI = ""
-
-	h.log.Printf("%s %s", req.Method, req.URL)
-
-	resp, err := h.client.Do(req)
-	if err != nil {
-		h.log.Printf("Proxied request failed: %v", err)
-
-		resp = &http.Response{
-			Status:     http.StatusText(http.StatusBadGateway),
-			StatusCode: http.StatusBadGateway,
-		}
-	}
-
-	if resp.StatusCode >= 300 && resp.StatusCode <= 399 {
-		_ = addAbsLocationHeader(resp, req)
-	}
 
-	if err := h.writeResponse(resp); err != nil {
+	if err := h.fc.Send(nil); err != nil {
 		h.log.Printf("Failed to write response: %v", err)
 
 		_ = h.dc.Close()
@@ -82,7 +85,7 @@ func (h *HTTPDataChannel) Write(p []byte) (n int, err error) {
 
 	for i := 0; i < count; i++ {
 		fragment := p[i*mtu : min((i+1)*mtu, len(p))]
-		if err := h.dc.Send(fragment); err != nil {
+		if err := h.fc.Send(fragment); err != nil {
 			return 0, err
 		}
 	}
@@ -97,6 +100,10 @@ func (h *HTTPDataChannel) onMessage(msg webrtc.DataChannelMessage) {
 	}
 
 	if _, err := h.w.Write(msg.Data); err != nil {
+		if errors.Is(err, errExchangeDone) {
+			return
+		}
+
 		h.log.Printf("Failed to write message data: %v", err)
 
 		_ = h.dc.Close()
@@ -105,24 +112,107 @@ func (h *HTTPDataChannel) onMessage(msg webrtc.DataChannelMessage) {
 }
 
 func (h *HTTPDataChannel) onClose() {
+	h.cancel(errDataChannelClosed)
+	h.fc.Close()
 	_ = h.w.Close()
 }
 
-func (h *HTTPDataChannel) writeResponse(resp *http.Response) error {
-	w := bufio.NewWriterSize(h, mtu)
-	if err := resp.Write(w); err != nil {
+// proxyHTTP reads a serialized request from r, proxies it with client, and writes the serialized response to w. The
+// proxied request, including a streamed response, is canceled when ctx is done.
+func proxyHTTP(ctx context.Context, log *log.Logger, client *http.Client, r io.Reader, w io.Writer) error {
+	req, err := http.ReadRequest(bufio.NewReader(r))
+	if err != nil {
+		log.Printf("Failed to read request: %v", err)
+
+		return err
+	}
+	req.RequestURI = ""
+	req = req.WithContext(ctx)
+
+	log.Printf("%s %s", req.Method, req.URL)
+
+	start := time.Now()
+	defer func() {
+		if ctx.Err() != nil {
+			log.Printf("Canceled %s %s after %s: %v", req.Method, req.URL, time.Since(start), context.Cause(ctx))
+		}
+	}()
+
+	resp := fetch(client, req)
+	if resp.Header.Get(responseTypeHeader) == "error" {
+		log.Printf("Proxied request failed: %s", resp.Status)
+	}
+
+	if resp.StatusCode >= 300 && resp.StatusCode <= 399 {
+		_ = addAbsLocationHeader(resp, req)
+	}
+
+	// Bodies of unknown length are chunked, rather than delimited by the end of the exchange, so that trailers can
+	// follow them. Trailers are always sent: fetch can't send "TE: trailers", and the tunnel client decodes them.
+	if bodyAllowed(req, resp) && (resp.ContentLength == -1 || len(resp.Trailer) > 0) {
+		resp.TransferEncoding = []string{"chunked"}
+		resp.ContentLength = -1
+		resp.Header.Del("Content-Length")
+		if resp.Trailer == nil {
+			resp.Trailer = make(http.Header)
+		}
+	}
+
+	if err := writeResponse(w, resp); err != nil {
+		log.Printf("Failed to write response: %v", err)
+
+		if resp.Body != nil {
+			_ = resp.Body.Close()
+		}
+
 		return err
 	}
-	if err := w.Flush(); err != nil {
+
+	return nil
+}
+
+func writeResponse(w io.Writer, resp *http.Response) error {
+	bw := bufio.NewWriterSize(w, mtu)
+	if resp.Body != nil {
+		resp.Body = &flushingReader{ReadCloser: resp.Body, w: bw}
+	}
+
+	// Hide bw's ReadFrom so that the body is copied one read at a time through flushingReader.
+	if err := resp.Write(struct{ io.Writer }{bw}); err != nil {
 		return err
 	}
-	if err := h.dc.Send(nil); err != nil {
+	if err := bw.Flush(); err != nil {
 		return err
 	}
 
 	return nil
 }
 
+// flushingReader flushes w before each read. Buffered output is sent before blocking on the next read, so streamed
+// body chunks reach the peer as soon as they're produced.
+type flushingReader struct {
+	io.ReadCloser
+
+	w *bufio.Writer
+}
+
+func (r *flushingReader) Read(p []byte) (int, error) {
+	if err := r.w.Flush(); err != nil {
+		return 0, err
+	}
+
+	return r.ReadCloser.Read(p)
+}
+
+// bodyAllowed reports whether resp, a response to req, may have a body.
+func bodyAllowed(req *http.Request, resp *http.Response) bool {
+	if req.Method == http.MethodHead || resp.Body == nil {
+		return false
+	}
+
+	return resp.StatusCode >= 200 && resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotModified
+}
+
 func addAbsLocationHeader(resp *http.Response, req *http.Request) error {
 	location, err := resp.Location()
 	if err != nil {
@@ -0,0 +1,335 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Multiplexed HTTP data channels carry many HTTP exchanges as streams. Each message is one frame:
+//
+//	stream ID (uint32, big endian) | type (uint8) | payload length (uint32, big endian) | payload
+//
+// The client opens a stream with a headers frame. Headers and data frames carry the bytes of the serialized HTTP
+// message, so a message may begin in a headers frame and continue in data frames. An end frame marks the end of a
+// message. A reset frame aborts the stream. The server answers on the same stream ID, starting with a headers frame.
+const (
+	muxFrameHeaders muxFrameType = iota + 1
+	muxFrameData
+	muxFrameEnd
+	muxFrameReset
+)
+
+const (
+	muxFrameHeaderSize    = 9
+	muxMaxPayloadSize     = mtu - muxFrameHeaderSize
+	muxStreamBufferLength = 1024 * 1024
+)
+
+var errStreamReset = errors.New("stream reset")
+
+type muxFrameType uint8
+
+type muxFrame struct {
+	streamID  uint32
+	frameType muxFrameType
+	payload   []byte
+}
+
+func parseMuxFrame(data []byte) (muxFrame, error) {
+	if len(data) < muxFrameHeaderSize {
+		return muxFrame{}, errors.New("short frame")
+	}
+
+	length := binary.BigEndian.Uint32(data[5:9])
+	if payloadLength := len(data) - muxFrameHeaderSize; uint64(length) != uint64(payloadLength) {
+		return muxFrame{}, fmt.Errorf("frame length %d doesn't match payload length %d", length, payloadLength)
+	}
+
+	return muxFrame{
+		streamID:  binary.BigEndian.Uint32(data[0:4]),
+		frameType: muxFrameType(data[4]),
+		payload:   data[muxFrameHeaderSize:],
+	}, nil
+}
+
+func (f muxFrame) marshal() []byte {
+	data := make([]byte, muxFrameHeaderSize+len(f.payload))
+	binary.BigEndian.PutUint32(data[0:4], f.streamID)
+	data[4] = byte(f.frameType)
+	binary.BigEndian.PutUint32(data[5:9], uint32(len(f.payload)))
+	copy(data[muxFrameHeaderSize:], f.payload)
+
+	return data
+}
+
+type HTTPMuxDataChannel struct {
+	log *log.Logger
+
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+
+	client *http.Client
+	dc     *webrtc.DataChannel
+	fc     *flowController
+
+	streams     map[uint32]*muxStream
+	streamsLock sync.Mutex
+}
+
+func NewHTTPMuxDataChannel(
+	ctx context.Context,
+	client *http.Client,
+	dc *webrtc.DataChannel,
+	flowControl FlowControl,
+) *HTTPMuxDataChannel {
+	ctx, cancel := context.WithCancelCause(ctx)
+
+	m := &HTTPMuxDataChannel{
+		log:     log.New(os.Stderr, fmt.Sprintf("[HTTP Mux Data Channel %d] ", *dc.ID()), log.LstdFlags),
+		ctx:     ctx,
+		cancel:  cancel,
+		client:  client,
+		dc:      dc,
+		fc:      newFlowController(dc, flowControl),
+		streams: make(map[uint32]*muxStream),
+	}
+
+	dc.OnMessage(m.onMessage)
+	dc.OnClose(m.onClose)
+
+	return m
+}
+
+func (m *HTTPMuxDataChannel) onMessage(msg webrtc.DataChannelMessage) {
+	frame, err := parseMuxFrame(msg.Data)
+	if err != nil {
+		m.log.Printf("Failed to parse frame: %v", err)
+
+		_ = m.dc.Close()
+		return
+	}
+
+	m.streamsLock.Lock()
+	s, ok := m.streams[frame.streamID]
+	if !ok && frame.frameType == muxFrameHeaders {
+		s = newMuxStream(m, frame.streamID)
+		m.streams[frame.streamID] = s
+		go s.run()
+	}
+	m.streamsLock.Unlock()
+
+	if s == nil {
+		// The stream is finished or was never opened. Late frames are expected after a reset.
+		return
+	}
+
+	switch frame.frameType {
+	case muxFrameHeaders, muxFrameData:
+		if _, err := s.body.Write(frame.payload); err != nil && !errors.Is(err, errExchangeDone) {
+			m.log.Printf("Failed to write stream %d data: %v", s.id, err)
+		}
+
+	case muxFrameEnd:
+		s.body.CloseWithError(io.EOF)
+
+	case muxFrameReset:
+		s.reset()
+
+	default:
+		m.log.Printf("Unknown frame type %d on stream %d", frame.frameType, s.id)
+
+		s.reset()
+		_ = m.fc.Send(muxFrame{streamID: s.id, frameType: muxFrameReset}.marshal())
+
+	}
+}
+
+func (m *HTTPMuxDataChannel) onClose() {
+	m.cancel(errDataChannelClosed)
+	m.fc.Close()
+
+	m.streamsLock.Lock()
+	defer m.streamsLock.Unlock()
+
+	for _, s := range m.streams {
+		s.reset()
+	}
+}
+
+func (m *HTTPMuxDataChannel) removeStream(id uint32) {
+	m.streamsLock.Lock()
+	defer m.streamsLock.Unlock()
+
+	delete(m.streams, id)
+}
+
+// muxStream is one HTTP exchange on a multiplexed HTTP data channel.
+type muxStream struct {
+	m *HTTPMuxDataChannel
+
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+
+	id   uint32
+	body *streamBuffer
+
+	mu          sync.Mutex
+	isReset     bool
+	sentHeaders bool
+}
+
+func newMuxStream(m *HTTPMuxDataChannel, id uint32) *muxStream {
+	ctx, cancel := context.WithCancelCause(m.ctx)
+
+	return &muxStream{
+		m:      m,
+		ctx:    ctx,
+		cancel: cancel,
+		id:     id,
+		body:   newStreamBuffer(muxStreamBufferLength),
+	}
+}
+
+func (s *muxStream) run() {
+	defer s.m.removeStream(s.id)
+	defer s.cancel(errExchangeDone)
+	defer s.body.CloseWithError(errExchangeDone)
+
+	if err := proxyHTTP(s.ctx, s.m.log, s.m.client, s.body, s); err != nil {
+		_ = s.sendFrame(muxFrameReset, nil)
+		return
+	}
+
+	if err := s.sendFrame(muxFrameEnd, nil); err != nil {
+		s.m.log.Printf("Failed to end stream %d: %v", s.id, err)
+	}
+}
+
+// Write sends p as frames on the stream. The first frame is a headers frame.
+func (s *muxStream) Write(p []byte) (int, error) {
+	for i := 0; i < len(p); i += muxMaxPayloadSize {
+		s.mu.Lock()
+		frameType := muxFrameData
+		if !s.sentHeaders {
+			frameType = muxFrameHeaders
+			s.sentHeaders = true
+		}
+		s.mu.Unlock()
+
+		if err := s.sendFrame(frameType, p[i:min(i+muxMaxPayloadSize, len(p))]); err != nil {
+			return i, err
+		}
+	}
+
+	return len(p), nil
+}
+
+func (s *muxStream) sendFrame(frameType muxFrameType, payload []byte) error {
+	s.mu.Lock()
+	isReset := s.isReset
+	s.mu.Unlock()
+
+	if isReset {
+		return errStreamReset
+	}
+
+	return s.m.fc.Send(muxFrame{streamID: s.id, frameType: frameType, payload: payload}.marshal())
+}
+
+func (s *muxStream) reset() {
+	s.mu.Lock()
+	s.isReset = true
+	s.mu.Unlock()
+
+	s.cancel(errStreamReset)
+	s.body.CloseWithError(errStreamReset)
+}
+
+// streamBuffer is an in-memory pipe. Writes don't block until limit bytes are buffered, so a stream whose reader is
+// slow doesn't stall the other streams on its data channel until it has fallen well behind.
+type streamBuffer struct {
+	limit int
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	chunks [][]byte
+	size   int
+	err    error
+}
+
+func newStreamBuffer(limit int) *streamBuffer {
+	b := &streamBuffer{limit: limit}
+	b.cond = sync.NewCond(&b.mu)
+
+	return b
+}
+
+func (b *streamBuffer) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for len(b.chunks) == 0 && b.err == nil {
+		b.cond.Wait()
+	}
+
+	if len(b.chunks) == 0 {
+		return 0, b.err
+	}
+
+	n := copy(p, b.chunks[0])
+	if n == len(b.chunks[0]) {
+		b.chunks = b.chunks[1:]
+	} else {
+		b.chunks[0] = b.chunks[0][n:]
+	}
+	b.size -= n
+	b.cond.Broadcast()
+
+	return n, nil
+}
+
+func (b *streamBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for b.size >= b.limit && b.err == nil {
+		b.cond.Wait()
+	}
+
+	if b.err != nil {
+		return 0, b.err
+	}
+
+	b.chunks = append(b.chunks, append([]byte(nil), p...))
+	b.size += len(p)
+	b.cond.Broadcast()
+
+	return len(p), nil
+}
+
+// CloseWithError closes the buffer. Reads return err once buffered data is consumed, and writes return err. Only the
+// first error is kept. Closing with an error other than io.EOF discards buffered data.
+func (b *streamBuffer) CloseWithError(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.err != nil {
+		return
+	}
+
+	b.err = err
+	if err != io.EOF {
+		b.chunks = nil
+		b.size = 0
+	}
+	b.cond.Broadcast()
+}
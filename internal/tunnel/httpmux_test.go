@@ -0,0 +1,269 @@
+package tunnel
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestMuxFrameRoundTrip(t *testing.T) {
+	for _, f := range []muxFrame{
+		{streamID: 1, frameType: muxFrameHeaders, payload: []byte("GET / HTTP/1.1\r\n\r\n")},
+		{streamID: 0xfffffffe, frameType: muxFrameData, payload: bytes.Repeat([]byte("x"), muxMaxPayloadSize)},
+		{streamID: 3, frameType: muxFrameEnd, payload: []byte{}},
+		{streamID: 5, frameType: muxFrameReset, payload: []byte{}},
+	} {
+		data := f.marshal()
+		if len(data) != muxFrameHeaderSize+len(f.payload) {
+			t.Errorf("marshal(%d, %d): got %d bytes", f.streamID, f.frameType, len(data))
+		}
+
+		got, err := parseMuxFrame(data)
+		if err != nil {
+			t.Errorf("parseMuxFrame(%d, %d): %v", f.streamID, f.frameType, err)
+			continue
+		}
+		if got.streamID != f.streamID || got.frameType != f.frameType || !bytes.Equal(got.payload, f.payload) {
+			t.Errorf("parseMuxFrame(%d, %d): got %d, %d, %q", f.streamID, f.frameType, got.streamID, got.frameType,
+				got.payload)
+		}
+	}
+}
+
+func TestMuxFrameEncoding(t *testing.T) {
+	data := muxFrame{streamID: 0x01020304, frameType: muxFrameData, payload: []byte("hi")}.marshal()
+
+	want := []byte{0x01, 0x02, 0x03, 0x04, 0x02, 0x00, 0x00, 0x00, 0x02, 'h', 'i'}
+	if !bytes.Equal(data, want) {
+		t.Errorf("got %x, want %x", data, want)
+	}
+}
+
+func TestParseMuxFrameInvalid(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"empty":        {},
+		"short header": {0, 0, 0, 1, 1, 0, 0, 0},
+		"long length":  {0, 0, 0, 1, 1, 0, 0, 0, 3, 'a', 'b'},
+		"short length": {0, 0, 0, 1, 1, 0, 0, 0, 1, 'a', 'b'},
+	} {
+		if _, err := parseMuxFrame(data); err == nil {
+			t.Errorf("%s: got no error", name)
+		}
+	}
+}
+
+func TestHTTPMux(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		fmt.Fprintf(w, "hello %s", r.URL.Path)
+	}))
+	defer target.Close()
+
+	pc := connectTestTunnel(t, target.URL, true)
+	dc, err := pc.CreateDataChannel("http-mux", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frames := make(chan muxFrame, 64)
+	dc.OnOpen(func() {
+		// The slow request's header is split across a headers frame and a data frame.
+		_ = dc.Send(muxFrame{streamID: 1, frameType: muxFrameHeaders, payload: []byte("GET http://x/slow HT")}.marshal())
+		_ = dc.Send(muxFrame{streamID: 1, frameType: muxFrameData, payload: []byte("TP/1.1\r\nHost: x\r\n\r\n")}.marshal())
+		_ = dc.Send(muxFrame{streamID: 1, frameType: muxFrameEnd}.marshal())
+		fast := []byte("GET http://x/fast HTTP/1.1\r\nHost: x\r\n\r\n")
+		_ = dc.Send(muxFrame{streamID: 3, frameType: muxFrameHeaders, payload: fast}.marshal())
+		_ = dc.Send(muxFrame{streamID: 3, frameType: muxFrameEnd}.marshal())
+	})
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		f, err := parseMuxFrame(msg.Data)
+		if err != nil {
+			t.Errorf("parseMuxFrame: %v", err)
+			return
+		}
+		frames <- muxFrame{streamID: f.streamID, frameType: f.frameType, payload: append([]byte(nil), f.payload...)}
+	})
+
+	streams := map[uint32]*bytes.Buffer{1: {}, 3: {}}
+	var order []uint32
+	for len(order) < 2 {
+		select {
+		case f := <-frames:
+			body, ok := streams[f.streamID]
+			if !ok {
+				t.Fatalf("frame on unknown stream %d", f.streamID)
+			}
+			if body.Len() == 0 && f.frameType != muxFrameHeaders {
+				t.Fatalf("stream %d: first frame has type %d", f.streamID, f.frameType)
+			}
+
+			switch f.frameType {
+			case muxFrameHeaders, muxFrameData:
+				body.Write(f.payload)
+			case muxFrameEnd:
+				order = append(order, f.streamID)
+			default:
+				t.Fatalf("stream %d: unexpected frame type %d", f.streamID, f.frameType)
+			}
+
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for responses")
+		}
+	}
+
+	// The fast response isn't held up by the slow one.
+	if order[0] != 3 {
+		t.Errorf("streams ended in order %v, want the fast stream first", order)
+	}
+	for id, path := range map[uint32]string{1: "/slow", 3: "/fast"} {
+		if body := streams[id].String(); !strings.HasSuffix(body, "hello "+path) {
+			t.Errorf("stream %d: got %q", id, body)
+		}
+	}
+}
+
+func TestHTTPMuxDisabled(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello")
+	}))
+	defer target.Close()
+
+	pc := connectTestTunnel(t, target.URL, false)
+
+	mux, err := pc.CreateDataChannel("http-mux", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := make(chan struct{})
+	mux.OnClose(func() { close(closed) })
+
+	select {
+	case <-closed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("http-mux data channel wasn't closed")
+	}
+
+	// The client falls back to a data channel per request.
+	resp := tunnelHTTP(t, pc, "GET http://x/ HTTP/1.1\r\nHost: x\r\n\r\n")
+	if !strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n") || !strings.HasSuffix(resp, "hello") {
+		t.Errorf("got %q", resp)
+	}
+}
+
+// connectTestTunnel connects a peer to a tunnel that proxies requests to target.
+func connectTestTunnel(t *testing.T, target string, httpMux bool) *webrtc.PeerConnection {
+	t.Helper()
+
+	u, err := url.Parse(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes, err := NewRoutes([]Route{{Prefix: "/", Target: u}}, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub := NewHub(
+		routes,
+		nil,
+		nil,
+		false,
+		CookieModePerClient,
+		nil,
+		webrtc.Configuration{},
+		DefaultFlowControl,
+		httpMux,
+	)
+
+	jar := newVirtualHostJar(routes)
+	tun, err := NewTunnel(webrtc.Configuration{}, hub.handlers, "testclient", jar, func(*webrtc.ICECandidate) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = tun.Close() })
+
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = pc.Close() })
+
+	connected := make(chan struct{})
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateConnected {
+			close(connected)
+		}
+	})
+
+	if _, err := pc.CreateDataChannel("control", nil); err != nil {
+		t.Fatal(err)
+	}
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+
+	if _, err := tun.RegisterOffer(*pc.LocalDescription()); err != nil {
+		t.Fatal(err)
+	}
+	// The answer is complete once the tunnel has gathered its candidates.
+	for tun.pc.ICEGatheringState() != webrtc.ICEGatheringStateComplete {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := pc.SetRemoteDescription(*tun.pc.LocalDescription()); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-connected:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out connecting")
+	}
+
+	return pc
+}
+
+// tunnelHTTP sends a serialized request over a new http data channel and returns the serialized response.
+func tunnelHTTP(t *testing.T, pc *webrtc.PeerConnection, req string) string {
+	t.Helper()
+
+	dc, err := pc.CreateDataChannel("http", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var resp bytes.Buffer
+	done := make(chan struct{})
+	dc.OnOpen(func() {
+		_ = dc.Send([]byte(req))
+		_ = dc.Send([]byte{})
+	})
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		if len(msg.Data) == 0 {
+			close(done)
+			return
+		}
+		resp.Write(msg.Data)
+	})
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for response")
+	}
+
+	return resp.String()
+}
@@ -4,15 +4,23 @@ import (
 	"context"
 	"errors"
 	"log"
+	"net"
 	"net/http"
-	"net/http/httptest"
-	"net/url"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/andrewmthomas87/web-p2p-tunnel/internal/signaling"
 	"github.com/pion/webrtc/v4"
 )
 
+// Reasons a client may not use the tunnel yet, other than its control data channel.
+var (
+	errClientNotAuthenticated = errors.New("client isn't authenticated")
+	errClientSASNotConfirmed  = errors.New("client's short authentication string isn't confirmed")
+	errClientNotApproved      = errors.New("client isn't approved")
+)
+
 type Signaler interface {
 	Offers() <-chan signaling.Offer
 	Answers() chan<- signaling.Answer
@@ -24,18 +32,105 @@ type Hub struct {
 	log *log.Logger
 
 	webrtcConfig webrtc.Configuration
+	flowControl  FlowControl
+	metadata     ControlMetadata
 
+	routes    *Routes
+	auth      *Auth
+	verifySAS bool
+	jars      *cookieJars
 	transport http.RoundTripper
-	tunnels   map[string]*Tunnel
+	wsProxy   *webSocketProxy
+	handlers  *DataChannelMux
+	approver  ClientApprover
+
+	tunnels     map[string]*Tunnel
+	tunnelsLock sync.Mutex
+
+	controls     map[string]*ControlDataChannel
+	controlsLock sync.Mutex
+
+	authenticated     map[string]bool
+	authenticatedLock sync.Mutex
+
+	sasExchanges map[string]*sasExchange
+	sas          map[string]string
+	sasConfirmed map[string]bool
+	sasLock      sync.Mutex
+
+	approved          map[string]bool
+	approvalRequested map[string]bool
+	approvalsLock     sync.Mutex
 }
 
-func NewHub(target *url.URL, changeHostHeader, changeOriginHeader bool, webrtcConfig webrtc.Configuration) *Hub {
-	return &Hub{
+// NewHub creates a hub that tunnels HTTP requests and WebSockets to the targets of routes, rewriting headers with
+// headerRules. Cookies are kept according to cookieMode, and, if cookieStore is set, saved to it. If auth is set,
+// clients must authenticate with it before their data channels, other than control, are handled. If verifySAS is set,
+// so must their short authentication strings be confirmed with ConfirmSAS. Data channel handlers for other protocols
+// may be registered with Handle and HandlePrefix.
+func NewHub(
+	routes *Routes,
+	headerRules HeaderRules,
+	auth *Auth,
+	verifySAS bool,
+	cookieMode string,
+	cookieStore *CookieStore,
+	webrtcConfig webrtc.Configuration,
+	flowControl FlowControl,
+	httpMux bool,
+) *Hub {
+	h := &Hub{
 		log:          log.New(os.Stderr, "[Tunnel hub] ", log.LstdFlags),
 		webrtcConfig: webrtcConfig,
-		transport:    newHandlerTransport(newSingleHostReverseProxy(target, changeHostHeader, changeOriginHeader)),
+		flowControl:  flowControl,
+		metadata:     newControlMetadata(routes),
+		routes:       routes,
+		auth:         auth,
+		verifySAS:    verifySAS,
+		jars:         newCookieJars(routes, cookieMode, cookieStore),
+		transport:    newHandlerTransport(newRouter(routes, headerRules)),
+		wsProxy:      newWebSocketProxy(routes, headerRules),
+		handlers:     NewDataChannelMux(),
 		tunnels:      make(map[string]*Tunnel),
+		controls:     make(map[string]*ControlDataChannel),
+
+		authenticated: make(map[string]bool),
+
+		sasExchanges: make(map[string]*sasExchange),
+		sas:          make(map[string]string),
+		sasConfirmed: make(map[string]bool),
+
+		approved:          make(map[string]bool),
+		approvalRequested: make(map[string]bool),
 	}
+
+	h.Handle("control", DataChannelHandlerFunc(h.handleControl))
+	h.Handle("http", DataChannelHandlerFunc(h.handleHTTP))
+	h.Handle("websocket", DataChannelHandlerFunc(h.handleWebSocket))
+	if httpMux {
+		// Without a handler, the channel is closed, which tells the client to fall back to a data channel per
+		// request.
+		h.Handle("http-mux", DataChannelHandlerFunc(h.handleHTTPMux))
+	}
+
+	return h
+}
+
+// Handle registers handler for data channels labeled label.
+func (h *Hub) Handle(label string, handler DataChannelHandler) {
+	h.handlers.Handle(label, handler)
+}
+
+// HandlePrefix registers handler for data channels with labels starting with prefix.
+func (h *Hub) HandlePrefix(prefix string, handler DataChannelHandler) {
+	h.handlers.HandlePrefix(prefix, handler)
+}
+
+// SetClientApprover makes clients wait to be approved by approve before their data channels, other than control, are
+// handled. Clients are submitted for approval once they're authenticated and have sent their control hello, or once
+// approvalHelloTimeout passes without one. It must be called before Run.
+func (h *Hub) SetClientApprover(approve ClientApprover) {
+	h.approver = approve
 }
 
 func (h *Hub) Run(ctx context.Context, signaler Signaler) error {
@@ -49,6 +144,11 @@ func (h *Hub) Run(ctx context.Context, signaler Signaler) error {
 	for {
 		select {
 		case offer := <-offers:
+			if !h.authenticateOffer(offer) {
+				// The offer isn't answered, so the client's connection fails.
+				continue
+			}
+
 			answer, err := h.handleOffer(offer, h.onICECandidate(offer.ClientID, localICECandidates))
 			if err != nil {
 				return err
@@ -84,34 +184,355 @@ func (h *Hub) handleOffer(
 	offer signaling.Offer,
 	onICECandidate func(*webrtc.ICECandidate),
 ) (signaling.Answer, error) {
-	_, ok := h.tunnels[offer.ClientID]
-	if ok {
+	if h.tunnel(offer.ClientID) != nil {
 		return signaling.Answer{}, errors.New("received offer for open tunnel")
 	}
 
-	t, err := NewTunnel(h.webrtcConfig, h.transport, offer.ClientID, onICECandidate)
+	handler := DataChannelHandlerFunc(h.handleDataChannel)
+	jar := h.jars.newTunnelJar()
+	t, err := NewTunnel(h.webrtcConfig, handler, offer.ClientID, jar, onICECandidate)
 	if err != nil {
+		h.jars.releaseTunnelJar(jar)
 		return signaling.Answer{}, err
 	}
+	h.tunnelsLock.Lock()
 	h.tunnels[offer.ClientID] = t
+	h.tunnelsLock.Unlock()
 
 	h.log.Printf("Created tunnel for client %s", offer.ClientID)
 
+	// The client's state is forgotten once its tunnel closes, so that it doesn't build up as clients come and go.
+	context.AfterFunc(t.ctx, func() {
+		h.forgetClient(offer.ClientID, t)
+		h.jars.releaseTunnelJar(jar)
+	})
+
+	if !h.isAuthenticated(offer.ClientID) {
+		time.AfterFunc(authTimeout, func() {
+			if !h.isAuthenticated(offer.ClientID) {
+				h.log.Printf("Closing tunnel for client %s. Client didn't authenticate in %s.", offer.ClientID, authTimeout)
+
+				_ = t.Close()
+			}
+		})
+	}
+
+	if h.approver != nil {
+		// Clients that don't send a hello are still submitted for approval, without their name and user agent.
+		time.AfterFunc(approvalHelloTimeout, func() {
+			if h.tunnel(offer.ClientID) == t {
+				h.requestApproval(offer.ClientID)
+			}
+		})
+	}
+
 	answer, err := t.RegisterOffer(offer.Data)
 	if err != nil {
 		return signaling.Answer{}, err
 	}
 
+	e, err := newSASExchange(t)
+	if err != nil {
+		// With -verify-sas, the client can't be confirmed, so it's never served.
+		h.log.Printf("Failed to start short authentication string exchange with client %s: %v", offer.ClientID, err)
+	} else {
+		h.sasLock.Lock()
+		h.sasExchanges[offer.ClientID] = e
+		h.sasLock.Unlock()
+	}
+
 	return signaling.Answer{
 		ClientID: offer.ClientID,
 		Data:     answer,
 	}, nil
 }
 
-func (h *Hub) handleRemoteICECandidate(iceCandidate signaling.ICECandidate) error {
-	t, ok := h.tunnels[iceCandidate.ClientID]
+// forgetClient forgets the client clientID's tunnel t, if it's still the client's, and whether the client is
+// authenticated, confirmed, and approved.
+func (h *Hub) forgetClient(clientID string, t *Tunnel) {
+	h.tunnelsLock.Lock()
+	if h.tunnels[clientID] == t {
+		delete(h.tunnels, clientID)
+	}
+	h.tunnelsLock.Unlock()
+
+	h.authenticatedLock.Lock()
+	delete(h.authenticated, clientID)
+	h.authenticatedLock.Unlock()
+
+	h.sasLock.Lock()
+	delete(h.sasExchanges, clientID)
+	delete(h.sas, clientID)
+	delete(h.sasConfirmed, clientID)
+	h.sasLock.Unlock()
+
+	h.approvalsLock.Lock()
+	delete(h.approved, clientID)
+	delete(h.approvalRequested, clientID)
+	h.approvalsLock.Unlock()
+}
+
+// tunnel returns the tunnel of the client clientID, or nil if there isn't one.
+func (h *Hub) tunnel(clientID string) *Tunnel {
+	h.tunnelsLock.Lock()
+	defer h.tunnelsLock.Unlock()
+
+	return h.tunnels[clientID]
+}
+
+// control returns the control data channel of the client clientID, or nil if there isn't one.
+func (h *Hub) control(clientID string) *ControlDataChannel {
+	h.controlsLock.Lock()
+	defer h.controlsLock.Unlock()
+
+	return h.controls[clientID]
+}
+
+// authenticateOffer authenticates the client of offer if the offer has an HMAC, and reports whether the offer should
+// be answered. Offers without an HMAC are answered, and their clients may authenticate over the control channel.
+func (h *Hub) authenticateOffer(offer signaling.Offer) bool {
+	if h.auth == nil || offer.Auth == "" {
+		return true
+	}
+
+	// The client's address isn't known until it connects.
+	if err := h.auth.verify(offer.ClientID, offer.ClientID, "offer", offer.Data.SDP, offer.Auth); err != nil {
+		return false
+	}
+	h.setAuthenticated(offer.ClientID)
+
+	return true
+}
+
+// authKey returns what the failed authentication attempts of the client clientID are counted against: its remote
+// address without the port, or its ID if the address isn't known.
+func (h *Hub) authKey(clientID string) string {
+	if t := h.tunnel(clientID); t != nil {
+		if host, _, err := net.SplitHostPort(t.RemoteAddr()); err == nil {
+			return host
+		}
+	}
+
+	return clientID
+}
+
+// isAuthenticated reports whether the client clientID is authenticated, if it must be.
+func (h *Hub) isAuthenticated(clientID string) bool {
+	if h.auth == nil {
+		return true
+	}
+
+	h.authenticatedLock.Lock()
+	defer h.authenticatedLock.Unlock()
+
+	return h.authenticated[clientID]
+}
+
+func (h *Hub) setAuthenticated(clientID string) {
+	h.log.Printf("Client %s authenticated", clientID)
+
+	h.authenticatedLock.Lock()
+	defer h.authenticatedLock.Unlock()
+
+	h.authenticated[clientID] = true
+}
+
+// ConfirmSAS confirms the clients with the short authentication string sas, as shown by their pages, and reports
+// whether there were any.
+func (h *Hub) ConfirmSAS(sas string) bool {
+	var clientIDs []string
+	h.sasLock.Lock()
+	for clientID, s := range h.sas {
+		if !h.sasConfirmed[clientID] && sameSAS(s, sas) {
+			clientIDs = append(clientIDs, clientID)
+		}
+	}
+	h.sasLock.Unlock()
+
+	for _, clientID := range clientIDs {
+		h.confirmSAS(clientID)
+		h.identifyClient(clientID)
+
+		if c := h.control(clientID); c != nil {
+			_ = c.send(0, "sasConfirmed", struct{}{})
+		}
+	}
+
+	return len(clientIDs) > 0
+}
+
+// sasExchange returns the short authentication string exchange of the client clientID, or nil if there isn't one.
+func (h *Hub) sasExchange(clientID string) *sasExchange {
+	h.sasLock.Lock()
+	defer h.sasLock.Unlock()
+
+	return h.sasExchanges[clientID]
+}
+
+// setSAS logs the short authentication string of the client clientID, and keeps it to be confirmed if it must be.
+func (h *Hub) setSAS(clientID, sas string) {
+	h.log.Printf("Client %s's short authentication string: %s", clientID, sas)
+
+	if !h.verifySAS {
+		return
+	}
+
+	h.sasLock.Lock()
+	defer h.sasLock.Unlock()
+
+	h.sas[clientID] = sas
+}
+
+// isSASConfirmed reports whether the short authentication string of the client clientID is confirmed, if it must be.
+func (h *Hub) isSASConfirmed(clientID string) bool {
+	if !h.verifySAS {
+		return true
+	}
+
+	h.sasLock.Lock()
+	defer h.sasLock.Unlock()
+
+	return h.sasConfirmed[clientID]
+}
+
+func (h *Hub) confirmSAS(clientID string) {
+	h.log.Printf("Client %s's short authentication string is confirmed", clientID)
+
+	h.sasLock.Lock()
+	defer h.sasLock.Unlock()
+
+	h.sasConfirmed[clientID] = true
+}
+
+// mayUseTunnel reports whether the client clientID is authenticated, confirmed, and approved, as far as it must be.
+func (h *Hub) mayUseTunnel(clientID string) bool {
+	return h.denied(clientID) == nil
+}
+
+// denied returns why the client clientID may not use the tunnel yet, or nil if it may.
+func (h *Hub) denied(clientID string) error {
+	switch {
+	case !h.isAuthenticated(clientID):
+		return errClientNotAuthenticated
+	case !h.isSASConfirmed(clientID):
+		return errClientSASNotConfirmed
+	case !h.isApproved(clientID):
+		return errClientNotApproved
+	}
+
+	return nil
+}
+
+// identifyClient switches the client clientID to its cookie jar, if it sent a key in its hello, once it may use the
+// tunnel. Until then, it could read and fill the jar of whichever key it sent.
+func (h *Hub) identifyClient(clientID string) {
+	if !h.mayUseTunnel(clientID) {
+		return
+	}
+	t, c := h.tunnel(clientID), h.control(clientID)
+	if t == nil || c == nil {
+		return
+	}
+	jar, ok := t.client.Jar.(*clientJar)
 	if !ok {
-		return errors.New("received message for unknown tunnel")
+		return
+	}
+	hello, ok := c.receivedHello()
+	if !ok || hello.ClientKey == "" {
+		return
+	}
+
+	if id, ok := jar.identify(hello.ClientKey); ok {
+		h.log.Printf("Client %s uses cookie jar %s", clientID, id)
+	}
+}
+
+// isApproved reports whether the client clientID is approved, if it must be.
+func (h *Hub) isApproved(clientID string) bool {
+	if h.approver == nil {
+		return true
+	}
+
+	h.approvalsLock.Lock()
+	defer h.approvalsLock.Unlock()
+
+	return h.approved[clientID]
+}
+
+// requestApproval submits the client clientID for approval, once it's authenticated, with the name and user agent
+// from its hello if it sent one. The client is told that it's waiting, and if it's denied, it's told so before its
+// tunnel is closed.
+func (h *Hub) requestApproval(clientID string) {
+	if h.approver == nil || !h.isAuthenticated(clientID) {
+		return
+	}
+	t := h.tunnel(clientID)
+	if t == nil || t.ctx.Err() != nil {
+		return
+	}
+
+	h.approvalsLock.Lock()
+	requested := h.approvalRequested[clientID]
+	h.approvalRequested[clientID] = true
+	h.approvalsLock.Unlock()
+	if requested {
+		return
+	}
+
+	var hello controlHello
+	if c := h.control(clientID); c != nil {
+		hello, _ = c.receivedHello()
+		_ = c.Notice("info", "Waiting for the tunnel's operator to approve this client")
+	}
+	h.log.Printf("Client %s is waiting to be approved", clientID)
+
+	go func() {
+		approved := h.approver(t.ctx, ClientApproval{
+			ID:         clientID,
+			Name:       hello.Name,
+			UserAgent:  hello.UserAgent,
+			RemoteAddr: t.RemoteAddr(),
+		})
+		if t.ctx.Err() != nil {
+			return
+		}
+
+		if !approved {
+			h.log.Printf("Client %s is denied", clientID)
+
+			if c := h.control(clientID); c != nil {
+				_ = c.GoingAway("the tunnel's operator didn't approve this client")
+			}
+			_ = t.Close()
+			return
+		}
+
+		// The tunnel is checked again with the lock held, so that the client isn't approved after it's forgotten.
+		h.approvalsLock.Lock()
+		closed := t.ctx.Err() != nil
+		if !closed {
+			h.approved[clientID] = true
+		}
+		h.approvalsLock.Unlock()
+		if closed {
+			return
+		}
+
+		h.log.Printf("Client %s is approved", clientID)
+		h.identifyClient(clientID)
+
+		if c := h.control(clientID); c != nil {
+			_ = c.send(0, "approved", struct{}{})
+		}
+	}()
+}
+
+func (h *Hub) handleRemoteICECandidate(iceCandidate signaling.ICECandidate) error {
+	t := h.tunnel(iceCandidate.ClientID)
+	if t == nil {
+		// The tunnel may have closed while the client's candidates were on their way.
+		h.log.Printf("Ignoring ICE candidate of client %s. No open tunnel.", iceCandidate.ClientID)
+		return nil
 	}
 
 	if err := t.AddICECandidate(iceCandidate.Data); err != nil {
@@ -124,6 +545,22 @@ func (h *Hub) handleRemoteICECandidate(iceCandidate signaling.ICECandidate) erro
 func (h *Hub) close() error {
 	h.log.Println("Closing tunnels...")
 
+	h.controlsLock.Lock()
+	var wg sync.WaitGroup
+	for _, c := range h.controls {
+		wg.Add(1)
+		go func(c *ControlDataChannel) {
+			defer wg.Done()
+
+			_ = c.GoingAway("server shutting down")
+		}(c)
+	}
+	h.controlsLock.Unlock()
+	wg.Wait()
+
+	h.tunnelsLock.Lock()
+	defer h.tunnelsLock.Unlock()
+
 	for _, t := range h.tunnels {
 		err := t.Close()
 		if err != nil {
@@ -134,21 +571,80 @@ func (h *Hub) close() error {
 	return nil
 }
 
-type handlerTransport struct {
-	handler http.Handler
-	http.ResponseWriter
+// handleDataChannel dispatches data channels to their handlers. Until the client authenticates, its short
+// authentication string is confirmed, and it's approved, only its control data channel is handled.
+func (h *Hub) handleDataChannel(ctx context.Context, dc *webrtc.DataChannel, client ClientInfo) {
+	var err error
+	if dc.Label() != "control" {
+		err = h.denied(client.ID)
+	}
+	if err != nil {
+		h.log.Printf("Closing data channel %q of client %s: %v", dc.Label(), client.ID[:6], err)
+
+		// Closing the data channel before it opens doesn't close it for the client.
+		dc.OnOpen(func() {
+			_ = dc.Close()
+		})
+		return
+	}
+
+	h.handlers.HandleDataChannel(ctx, dc, client)
 }
 
-func newHandlerTransport(handler http.Handler) http.RoundTripper {
-	return &handlerTransport{handler: handler}
+func (h *Hub) handleHTTP(ctx context.Context, dc *webrtc.DataChannel, client ClientInfo) {
+	hdc := NewHTTPDataChannel(ctx, newHTTPClient(h.transport, client.Jar), dc, h.flowControl)
+	go hdc.Run()
 }
 
-func (ht *handlerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
-	rw := httptest.NewRecorder()
-	ht.handler.ServeHTTP(rw, req)
+func (h *Hub) handleHTTPMux(ctx context.Context, dc *webrtc.DataChannel, client ClientInfo) {
+	NewHTTPMuxDataChannel(ctx, newHTTPClient(h.transport, client.Jar), dc, h.flowControl)
+}
+
+func (h *Hub) handleWebSocket(ctx context.Context, dc *webrtc.DataChannel, client ClientInfo) {
+	NewWebSocketDataChannel(ctx, h.wsProxy, client.Jar, dc, h.flowControl)
+}
 
-	res := rw.Result()
-	res.Request = req
+func (h *Hub) handleControl(ctx context.Context, dc *webrtc.DataChannel, client ClientInfo) {
+	c := NewControlDataChannel(dc, h.handlers.Labels(), h.metadata)
+	if !h.isAuthenticated(client.ID) {
+		err := c.requireAuth(func(challenge, mac string) error {
+			if err := h.auth.verify(h.authKey(client.ID), client.ID, "control channel", challenge, mac); err != nil {
+				return err
+			}
+			h.setAuthenticated(client.ID)
+			h.identifyClient(client.ID)
+			h.requestApproval(client.ID)
 
-	return res, nil
+			return nil
+		})
+		if err != nil {
+			h.log.Printf("Failed to require authentication of client %s: %v", client.ID, err)
+
+			_ = dc.Close()
+			return
+		}
+	}
+	c.setOnHello(func(controlHello) {
+		h.identifyClient(client.ID)
+		h.requestApproval(client.ID)
+	})
+	handleSASMessages(c, h.sasExchange(client.ID), func(sas string) {
+		h.setSAS(client.ID, sas)
+	})
+	handleCookieMessages(c, client.Jar, func() error {
+		return h.denied(client.ID)
+	})
+
+	h.controlsLock.Lock()
+	h.controls[client.ID] = c
+	h.controlsLock.Unlock()
+
+	dc.OnClose(func() {
+		h.controlsLock.Lock()
+		defer h.controlsLock.Unlock()
+
+		if h.controls[client.ID] == c {
+			delete(h.controls, client.ID)
+		}
+	})
 }
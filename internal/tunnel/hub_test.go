@@ -0,0 +1,171 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/andrewmthomas87/web-p2p-tunnel/internal/signaling"
+	"github.com/pion/webrtc/v4"
+)
+
+func TestHubForgetsClosedTunnels(t *testing.T) {
+	routes, err := NewRoutes(nil, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub := NewHub(routes, nil, nil, false, CookieModePerClient, nil, webrtc.Configuration{}, DefaultFlowControl, false)
+
+	offerTestHub(t, hub, "testclient")
+	if err := hub.tunnel("testclient").Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for hub.tunnel("testclient") != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("closed tunnel wasn't forgotten")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Late candidates are ignored, and the client may connect again.
+	candidate := signaling.ICECandidate{ClientID: "testclient", Data: webrtc.ICECandidateInit{Candidate: ""}}
+	if err := hub.handleRemoteICECandidate(candidate); err != nil {
+		t.Errorf("candidate for closed tunnel: %v", err)
+	}
+	offerTestHub(t, hub, "testclient")
+}
+
+func TestHubCookieMessagesNeedApproval(t *testing.T) {
+	routes, err := NewRoutes(nil, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub := NewHub(routes, nil, nil, false, CookieModeShared, nil, webrtc.Configuration{}, DefaultFlowControl, false)
+
+	approve := make(chan bool)
+	hub.SetClientApprover(func(ctx context.Context, client ClientApproval) bool {
+		select {
+		case approved := <-approve:
+			return approved
+		case <-ctx.Done():
+			return false
+		}
+	})
+
+	pc := offerTestHub(t, hub, "testclient")
+	dc, err := pc.CreateDataChannel("control", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := make(chan controlMessage, 16)
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		var message controlMessage
+		if err := json.Unmarshal(msg.Data, &message); err == nil {
+			messages <- message
+		}
+	})
+	opened := make(chan struct{})
+	dc.OnOpen(func() { close(opened) })
+	<-opened
+
+	send := func(id uint64, messageType string, data any) {
+		b, _ := json.Marshal(data)
+		msg, _ := json.Marshal(controlMessage{ID: id, Type: messageType, Data: b})
+		if err := dc.Send(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reply := func(id uint64) controlMessage {
+		for {
+			select {
+			case message := <-messages:
+				if message.ID == id {
+					return message
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatalf("timed out waiting for reply to %d", id)
+			}
+		}
+	}
+
+	send(1, "hello", controlHello{Version: 1})
+	send(2, "setCookie", controlSetCookie{URL: "http://localhost/", Cookie: "session=stolen"})
+	if message := reply(2); message.Type != "error" {
+		t.Errorf("setCookie before approval: got %s, want error", message.Type)
+	}
+	send(3, "getCookies", controlGetCookies{URL: "http://localhost/"})
+	if message := reply(3); message.Type != "error" {
+		t.Errorf("getCookies before approval: got %s, want error", message.Type)
+	}
+
+	approve <- true
+	deadline := time.Now().Add(10 * time.Second)
+	for !hub.isApproved("testclient") {
+		if time.Now().After(deadline) {
+			t.Fatal("client wasn't approved")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	send(4, "getCookies", controlGetCookies{URL: "http://localhost/"})
+	if message := reply(4); message.Type != "cookies" {
+		t.Errorf("getCookies after approval: got %s, want cookies", message.Type)
+	}
+}
+
+// offerTestHub connects a peer to hub as the client clientID, through handleOffer.
+func offerTestHub(t *testing.T, hub *Hub, clientID string) *webrtc.PeerConnection {
+	t.Helper()
+
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = pc.Close() })
+
+	connected := make(chan struct{})
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateConnected {
+			close(connected)
+		}
+	})
+
+	if _, err := pc.CreateDataChannel("control", nil); err != nil {
+		t.Fatal(err)
+	}
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+
+	offerMsg := signaling.Offer{ClientID: clientID, Data: *pc.LocalDescription()}
+	if _, err := hub.handleOffer(offerMsg, func(*webrtc.ICECandidate) {}); err != nil {
+		t.Fatal(err)
+	}
+	tun := hub.tunnel(clientID)
+	t.Cleanup(func() { _ = tun.Close() })
+
+	// The answer is complete once the tunnel has gathered its candidates.
+	for tun.pc.ICEGatheringState() != webrtc.ICEGatheringStateComplete {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := pc.SetRemoteDescription(*tun.pc.LocalDescription()); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-connected:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out connecting")
+	}
+
+	return pc
+}
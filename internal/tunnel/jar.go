@@ -0,0 +1,495 @@
+package tunnel
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cookie modes.
+const (
+	// CookieModePerClient gives each client its own jar. Clients that send a key in their control hello keep their jar
+	// across connections.
+	CookieModePerClient = "per-client"
+	// CookieModeShared gives all clients one jar.
+	CookieModeShared = "shared"
+	// CookieModePassthrough doesn't keep cookies. Cookie headers are sent to targets, and Set-Cookie headers are sent
+	// to clients, as is.
+	CookieModePassthrough = "passthrough"
+)
+
+// virtualHostJar keeps a separate cookie jar for each virtual host, so cookies set by one virtual host's target, even
+// for a parent domain, are never sent to another's. Aliases share the jar of their virtual host.
+type virtualHostJar struct {
+	routes *Routes
+
+	mu   sync.Mutex
+	jars map[string]http.CookieJar
+}
+
+func newVirtualHostJar(routes *Routes) *virtualHostJar {
+	return &virtualHostJar{
+		routes: routes,
+		jars:   make(map[string]http.CookieJar),
+	}
+}
+
+func (j *virtualHostJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.jar(u).SetCookies(u, cookies)
+}
+
+func (j *virtualHostJar) Cookies(u *url.URL) []*http.Cookie {
+	return j.jar(u).Cookies(u)
+}
+
+func (j *virtualHostJar) jar(u *url.URL) http.CookieJar {
+	vhost, _ := j.routes.VirtualHost(u.Host)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	jar, ok := j.jars[vhost]
+	if !ok {
+		// cookiejar.New only fails for invalid options.
+		jar, _ = cookiejar.New(nil)
+		j.jars[vhost] = jar
+	}
+
+	return jar
+}
+
+// recordingJar is a virtualHostJar that records the cookies set in it, so that they can be copied to another jar and
+// saved to a CookieStore. If store is set, the jar is saved whenever cookies are set.
+type recordingJar struct {
+	log *log.Logger
+
+	id    string
+	store *CookieStore
+	jar   *virtualHostJar
+
+	mu      sync.Mutex
+	cookies map[string]StoredCookie
+
+	// saveMu orders saves, so that an older copy of the jar never replaces a newer one.
+	saveMu sync.Mutex
+}
+
+func newRecordingJar(routes *Routes, id string, store *CookieStore) *recordingJar {
+	return &recordingJar{
+		log:     log.New(os.Stderr, "[Cookie jar] ", log.LstdFlags),
+		id:      id,
+		store:   store,
+		jar:     newVirtualHostJar(routes),
+		cookies: make(map[string]StoredCookie),
+	}
+}
+
+func (j *recordingJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.mu.Lock()
+	j.setCookiesLocked(u, cookies)
+	j.mu.Unlock()
+
+	j.save()
+}
+
+func (j *recordingJar) Cookies(u *url.URL) []*http.Cookie {
+	return j.jar.Cookies(u)
+}
+
+// add sets stored cookies in the jar.
+func (j *recordingJar) add(cookies []StoredCookie) {
+	now := time.Now()
+
+	j.mu.Lock()
+	for _, c := range cookies {
+		u, err := url.Parse(c.URL)
+		if err != nil || c.Expired(now) {
+			continue
+		}
+
+		j.jar.SetCookies(u, []*http.Cookie{c.cookie()})
+	}
+	j.recordLocked(cookies, now)
+	j.mu.Unlock()
+
+	j.save()
+}
+
+// setCookiesLocked sets cookies in the jar and records them, so that the jar and the record never disagree.
+func (j *recordingJar) setCookiesLocked(u *url.URL, cookies []*http.Cookie) {
+	j.jar.SetCookies(u, cookies)
+
+	now := time.Now()
+	stored := make([]StoredCookie, 0, len(cookies))
+	for _, c := range cookies {
+		s := newStoredCookie(cookieURL(u), c, now)
+		if c.MaxAge < 0 {
+			s.Expires = time.Unix(0, 0)
+		}
+		stored = append(stored, s)
+	}
+
+	j.recordLocked(stored, now)
+}
+
+// recordLocked records cookies, forgetting expired ones.
+func (j *recordingJar) recordLocked(cookies []StoredCookie, now time.Time) {
+	for _, c := range cookies {
+		key := storedCookieKey(c)
+		if c.Expired(now) {
+			delete(j.cookies, key)
+		} else {
+			j.cookies[key] = c
+		}
+	}
+}
+
+// save saves the jar to its store, if it has one. The jar isn't locked while it's written, so requests using it
+// aren't held up by the disk.
+func (j *recordingJar) save() {
+	if j.store == nil {
+		return
+	}
+
+	j.saveMu.Lock()
+	defer j.saveMu.Unlock()
+
+	// The cookies are copied once saves are ordered, so each save has every change recorded before it.
+	if err := j.store.Save(j.id, j.stored()); err != nil {
+		j.log.Printf("Failed to save jar %s: %v", j.id, err)
+	}
+}
+
+// stored returns the jar's unexpired cookies.
+func (j *recordingJar) stored() []StoredCookie {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.storedLocked(time.Now())
+}
+
+func (j *recordingJar) storedLocked(now time.Time) []StoredCookie {
+	cookies := make([]StoredCookie, 0, len(j.cookies))
+	for key, c := range j.cookies {
+		if c.Expired(now) {
+			delete(j.cookies, key)
+			continue
+		}
+
+		cookies = append(cookies, c)
+	}
+
+	return cookies
+}
+
+// scriptCookies returns the cookies for u that scripts may read, those that aren't HttpOnly, with their attributes.
+func (j *recordingJar) scriptCookies(u *url.URL) []StoredCookie {
+	cookies := j.jar.Cookies(u)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	scriptCookies := make([]StoredCookie, 0, len(cookies))
+	for _, c := range cookies {
+		// A cookie that isn't recorded can't be known not to be HttpOnly, so it's left out.
+		s, ok := j.findLocked(u, c.Name, c.Value)
+		if !ok || s.HttpOnly {
+			continue
+		}
+
+		scriptCookies = append(scriptCookies, s)
+	}
+
+	return scriptCookies
+}
+
+// setScriptCookies sets cookies for u as a script would. Scripts can't set HttpOnly cookies, or replace them.
+func (j *recordingJar) setScriptCookies(u *url.URL, cookies []*http.Cookie) error {
+	// The cookies are checked and set without unlocking, so that an HttpOnly cookie set in between can't be replaced.
+	j.mu.Lock()
+	for _, c := range cookies {
+		if c.HttpOnly {
+			j.mu.Unlock()
+			return fmt.Errorf("cookie %s: scripts can't set HttpOnly cookies", c.Name)
+		}
+
+		existing, ok := j.cookies[storedCookieKey(newStoredCookie(cookieURL(u), c, time.Now()))]
+		if ok && existing.HttpOnly {
+			j.mu.Unlock()
+			return fmt.Errorf("cookie %s is HttpOnly", c.Name)
+		}
+	}
+	j.setCookiesLocked(u, cookies)
+	j.mu.Unlock()
+
+	j.save()
+
+	return nil
+}
+
+// findLocked finds the recorded cookie sent to u with name and value.
+func (j *recordingJar) findLocked(u *url.URL, name, value string) (StoredCookie, bool) {
+	host := strings.ToLower(u.Hostname())
+	requestPath := u.EscapedPath()
+	if requestPath == "" {
+		requestPath = "/"
+	}
+
+	for _, c := range j.cookies {
+		if c.Name != name || c.Value != value {
+			continue
+		}
+
+		domain, path, hostOnly := storedCookieScope(c)
+		if host != domain && (hostOnly || !strings.HasSuffix(host, "."+domain)) {
+			continue
+		}
+		if !hasPathPrefix(requestPath, path) && !(strings.HasSuffix(path, "/") && strings.HasPrefix(requestPath, path)) {
+			continue
+		}
+
+		return c, true
+	}
+
+	return StoredCookie{}, false
+}
+
+// cookieURL returns the URL recorded for cookies set by a response to u. The query isn't needed.
+func cookieURL(u *url.URL) string {
+	return (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path}).String()
+}
+
+// storedCookieKey identifies a cookie by its domain, path, and name, as a jar does. A cookie replaces the cookie with
+// the same key.
+func storedCookieKey(c StoredCookie) string {
+	domain, path, _ := storedCookieScope(c)
+	return domain + ";" + path + ";" + c.Name
+}
+
+// storedCookieScope returns the domain and path a cookie is sent to. Host-only cookies, without a Domain attribute,
+// are only sent to the host that set them.
+func storedCookieScope(c StoredCookie) (domain, path string, hostOnly bool) {
+	var host, dir string
+	if u, err := url.Parse(c.URL); err == nil {
+		host = strings.ToLower(u.Hostname())
+		dir = u.Path
+	}
+
+	domain = strings.TrimPrefix(strings.ToLower(c.Domain), ".")
+	if domain == "" {
+		domain, hostOnly = host, true
+	}
+
+	// Like net/http/cookiejar, a cookie without a path gets the directory of the URL's path.
+	path = c.Path
+	if !strings.HasPrefix(path, "/") {
+		path = "/"
+		if i := strings.LastIndex(dir, "/"); i > 0 {
+			path = dir[:i]
+		}
+	}
+
+	return domain, path, hostOnly
+}
+
+// cookieJarsMaxIdle is the number of jars kept in memory that no tunnel uses. Beyond it, the least recently used
+// are evicted, and loaded again from the store, if there is one, when they're next used.
+const cookieJarsMaxIdle = 1024
+
+// cookieJars creates the cookie jars of a hub's tunnels according to its cookie mode. Jars of clients that identify
+// themselves, and the shared jar, are kept while tunnels use them, and up to cookieJarsMaxIdle more. They're loaded
+// from and saved to store if it's set.
+type cookieJars struct {
+	log *log.Logger
+
+	routes *Routes
+	mode   string
+	store  *CookieStore
+
+	mu   sync.Mutex
+	jars map[string]*cookieJarEntry
+}
+
+type cookieJarEntry struct {
+	jar *recordingJar
+	// users is the number of tunnels using the jar. lastUsed is when the last one stopped.
+	users    int
+	lastUsed time.Time
+}
+
+func newCookieJars(routes *Routes, mode string, store *CookieStore) *cookieJars {
+	return &cookieJars{
+		log:    log.New(os.Stderr, "[Cookie jars] ", log.LstdFlags),
+		routes: routes,
+		mode:   mode,
+		store:  store,
+		jars:   make(map[string]*cookieJarEntry),
+	}
+}
+
+// newTunnelJar returns the jar of a new tunnel, or nil in CookieModePassthrough. It must be released with
+// releaseTunnelJar once the tunnel closes.
+func (c *cookieJars) newTunnelJar() http.CookieJar {
+	switch c.mode {
+	case CookieModePassthrough:
+		return nil
+	case CookieModeShared:
+		return c.acquire(SharedCookieJarID)
+	default:
+		return &clientJar{jars: c, jar: newRecordingJar(c.routes, "", nil)}
+	}
+}
+
+// releaseTunnelJar releases jar, returned by newTunnelJar, once its tunnel has closed.
+func (c *cookieJars) releaseTunnelJar(jar http.CookieJar) {
+	switch jar := jar.(type) {
+	case *recordingJar:
+		c.release(jar.id)
+	case *clientJar:
+		if id := jar.identifiedID(); id != "" {
+			c.release(id)
+		}
+	}
+}
+
+// acquire returns the jar id for a tunnel to use, loading it from the store if it isn't in memory.
+func (c *cookieJars) acquire(id string) *recordingJar {
+	c.mu.Lock()
+	if e, ok := c.jars[id]; ok {
+		e.users++
+		c.mu.Unlock()
+
+		return e.jar
+	}
+	c.mu.Unlock()
+
+	// The jar is loaded without the lock held, so that other tunnels' jars aren't held up by the disk.
+	jar := newRecordingJar(c.routes, id, nil)
+	if c.store != nil {
+		cookies, err := c.store.Load(id)
+		if err != nil {
+			c.log.Printf("Failed to load jar %s, starting empty: %v", id, err)
+		}
+
+		jar.add(cookies)
+		jar.store = c.store
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Another tunnel may have loaded the jar meanwhile.
+	e, ok := c.jars[id]
+	if !ok {
+		e = &cookieJarEntry{jar: jar}
+		c.jars[id] = e
+	}
+	e.users++
+
+	return e.jar
+}
+
+// release tells c that a tunnel stopped using the jar id, and evicts the least recently used idle jars beyond
+// cookieJarsMaxIdle.
+func (c *cookieJars) release(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.jars[id]
+	if !ok {
+		return
+	}
+	e.users--
+	e.lastUsed = time.Now()
+
+	var idle []string
+	for id, e := range c.jars {
+		if e.users == 0 {
+			idle = append(idle, id)
+		}
+	}
+	if len(idle) <= cookieJarsMaxIdle {
+		return
+	}
+
+	sort.Slice(idle, func(i, j int) bool {
+		return c.jars[idle[i]].lastUsed.Before(c.jars[idle[j]].lastUsed)
+	})
+	for _, id := range idle[:len(idle)-cookieJarsMaxIdle] {
+		delete(c.jars, id)
+	}
+}
+
+// clientJar is the jar of a tunnel in CookieModePerClient. It starts empty. Once the client identifies itself, it's
+// replaced by the client's jar, with the cookies set so far copied over.
+type clientJar struct {
+	jars *cookieJars
+
+	mu  sync.Mutex
+	jar *recordingJar
+	// id is the ID of the client's jar, once it's identified.
+	id         string
+	identified bool
+}
+
+func (j *clientJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.current().SetCookies(u, cookies)
+}
+
+func (j *clientJar) Cookies(u *url.URL) []*http.Cookie {
+	return j.current().Cookies(u)
+}
+
+func (j *clientJar) current() *recordingJar {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.jar
+}
+
+func (j *clientJar) scriptCookies(u *url.URL) []StoredCookie {
+	return j.current().scriptCookies(u)
+}
+
+func (j *clientJar) setScriptCookies(u *url.URL, cookies []*http.Cookie) error {
+	return j.current().setScriptCookies(u, cookies)
+}
+
+// identify switches to the jar of the client with key clientKey, and returns the jar's ID. A client may only identify
+// itself once per tunnel, so later calls return false.
+func (j *clientJar) identify(clientKey string) (string, bool) {
+	j.mu.Lock()
+	identified := j.identified
+	j.identified = true
+	j.mu.Unlock()
+	if identified {
+		return "", false
+	}
+
+	id := ClientJarID(clientKey)
+	jar := j.jars.acquire(id)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	jar.add(j.jar.stored())
+	j.jar = jar
+	j.id = id
+
+	return id, true
+}
+
+// identifiedID returns the ID of the client's jar, or "" if the client hasn't identified itself.
+func (j *clientJar) identifiedID() string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.id
+}
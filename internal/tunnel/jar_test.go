@@ -0,0 +1,63 @@
+package tunnel
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestClientJarIdentifyOnce(t *testing.T) {
+	routes, err := NewRoutes(nil, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jars := newCookieJars(routes, CookieModePerClient, nil)
+	u := &url.URL{Scheme: "http", Host: "localhost", Path: "/"}
+
+	other := jars.newTunnelJar().(*clientJar)
+	other.identify("other-client-key-0123")
+	other.SetCookies(u, []*http.Cookie{{Name: "session", Value: "other"}})
+
+	jar := jars.newTunnelJar().(*clientJar)
+	jar.SetCookies(u, []*http.Cookie{{Name: "theme", Value: "dark"}})
+	if _, ok := jar.identify("first-client-key-0123"); !ok {
+		t.Fatal("first identify failed")
+	}
+	// A second key doesn't give the client another jar.
+	if _, ok := jar.identify("other-client-key-0123"); ok {
+		t.Error("second identify succeeded")
+	}
+
+	cookies := jar.Cookies(u)
+	if len(cookies) != 1 || cookies[0].Name != "theme" {
+		t.Errorf("got cookies %v, want the ones set before identifying", cookies)
+	}
+}
+
+func TestCookieJarsEvictIdle(t *testing.T) {
+	routes, err := NewRoutes(nil, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jars := newCookieJars(routes, CookieModePerClient, nil)
+
+	inUse := jars.newTunnelJar().(*clientJar)
+	inUse.identify("in-use-client-key-0123")
+
+	for i := 0; i < cookieJarsMaxIdle+10; i++ {
+		jar := jars.newTunnelJar()
+		jar.(*clientJar).identify(fmt.Sprintf("idle-client-key-%04d", i))
+		jars.releaseTunnelJar(jar)
+	}
+
+	if got := len(jars.jars); got != cookieJarsMaxIdle+1 {
+		t.Errorf("got %d jars, want %d idle ones and the one in use", got, cookieJarsMaxIdle)
+	}
+	if _, ok := jars.jars[inUse.identifiedID()]; !ok {
+		t.Error("jar in use was evicted")
+	}
+	if _, ok := jars.jars[ClientJarID("idle-client-key-0000")]; ok {
+		t.Error("least recently used jar wasn't evicted")
+	}
+}
@@ -0,0 +1,239 @@
+package tunnel
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+const (
+	// maxRedirects is the number of redirects followed before giving up, as in the Fetch standard.
+	maxRedirects = 20
+	// maxReplayedBodySize is the size of the largest request body that's sent again after a redirect.
+	maxReplayedBodySize = 1 << 20
+
+	// redirectModeHeader is the redirect mode of the client's request: follow, error, or manual.
+	redirectModeHeader = "Web-P2p-Tunnel-Redirect"
+	// responseTypeHeader marks responses that the client must turn into a Fetch response of another type: error for a
+	// network error, and opaqueredirect for a redirect in manual mode.
+	responseTypeHeader = "Web-P2p-Tunnel-Response-Type"
+)
+
+// Redirect modes of requests, from the Fetch standard.
+const (
+	redirectFollow = "follow"
+	redirectError  = "error"
+	redirectManual = "manual"
+)
+
+// requestBodyHeaders are removed when a redirect changes the method, as in the Fetch standard.
+var requestBodyHeaders = []string{"Content-Encoding", "Content-Language", "Content-Location", "Content-Type"}
+
+// fetch sends req with client, handling redirects as the Fetch standard does for the request's redirect mode:
+//
+//   - follow: redirects are followed, up to 20. POST requests redirected by 301 or 302, and requests other than GET
+//     and HEAD redirected by 303, become GET requests without a body. Authorization and Cookie headers are dropped
+//     when a redirect leaves the request's origin.
+//   - error: a redirect is a network error.
+//   - manual: a redirect is returned as an opaque redirect.
+//
+// Requests without a redirect mode get redirects as is. Network errors are returned as 502 responses. Responses the
+// client must turn into network errors or opaque redirects are marked with responseTypeHeader.
+func fetch(client *http.Client, req *http.Request) *http.Response {
+	mode := req.Header.Get(redirectModeHeader)
+	req.Header.Del(redirectModeHeader)
+
+	// The client adds the jar's cookies to the Cookie header of each request it sends, so the caller's own are kept
+	// to start each redirected request's header with.
+	cookie := append([]string(nil), req.Header["Cookie"]...)
+
+	var body *replayableBody
+	if mode == redirectFollow && req.Body != nil && req.Body != http.NoBody {
+		body = &replayableBody{r: req.Body}
+		req.Body = body
+	}
+
+	for redirects := 0; ; redirects++ {
+		resp, err := client.Do(req)
+		if err != nil {
+			return networkErrorResponse(req, err.Error())
+		}
+		if !isRedirect(resp.StatusCode) {
+			return resp
+		}
+
+		switch mode {
+		case redirectError:
+			resp.Body.Close()
+			return networkErrorResponse(req, fmt.Sprintf("redirected with status %d in error mode", resp.StatusCode))
+		case redirectManual:
+			resp.Header.Set(responseTypeHeader, "opaqueredirect")
+			return resp
+		case redirectFollow:
+		default:
+			return resp
+		}
+
+		if resp.Header.Get("Location") == "" {
+			return resp
+		}
+		resp.Body.Close()
+
+		location, err := resp.Location()
+		if err != nil {
+			return networkErrorResponse(req, fmt.Sprintf("invalid redirect location: %v", err))
+		}
+		if location.Scheme != "http" && location.Scheme != "https" {
+			return networkErrorResponse(req, fmt.Sprintf("redirect to %s url", location.Scheme))
+		}
+		if redirects == maxRedirects {
+			return networkErrorResponse(req, fmt.Sprintf("more than %d redirects", maxRedirects))
+		}
+
+		next := req.Clone(req.Context())
+		next.URL = location
+		next.Host = location.Host
+
+		if resp.StatusCode == http.StatusSeeOther && req.Method != http.MethodGet && req.Method != http.MethodHead ||
+			(resp.StatusCode == http.StatusMovedPermanently || resp.StatusCode == http.StatusFound) &&
+				req.Method == http.MethodPost {
+			next.Method = http.MethodGet
+			next.Body = http.NoBody
+			next.ContentLength = 0
+			for _, name := range requestBodyHeaders {
+				next.Header.Del(name)
+			}
+		} else if req.Body != nil && req.Body != http.NoBody {
+			replayed, ok := body.replay()
+			if !ok {
+				return networkErrorResponse(req, "redirected request body is too large to send again")
+			}
+
+			next.Body = replayed
+		}
+
+		if !sameOrigin(req, next) {
+			next.Header.Del("Authorization")
+			cookie = nil
+		}
+		if cookie != nil {
+			next.Header["Cookie"] = cookie
+		} else {
+			next.Header.Del("Cookie")
+		}
+
+		req = next
+	}
+}
+
+// isRedirect reports whether status is a redirect status, as defined by the Fetch standard.
+func isRedirect(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect,
+		http.StatusPermanentRedirect:
+		return true
+	}
+
+	return false
+}
+
+// sameOrigin reports whether a and b are for the same origin. Hosts are compared without their scheme's default port,
+// so "example.com" and "example.com:80" are the same for http.
+func sameOrigin(a, b *http.Request) bool {
+	return strings.EqualFold(a.URL.Scheme, b.URL.Scheme) &&
+		strings.EqualFold(originHost(a.URL), originHost(b.URL))
+}
+
+// originHost returns u's host without its scheme's default port.
+func originHost(u *url.URL) string {
+	port := u.Port()
+	if port == "" ||
+		port == "80" && strings.EqualFold(u.Scheme, "http") ||
+		port == "443" && strings.EqualFold(u.Scheme, "https") {
+		return u.Hostname()
+	}
+
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// networkErrorResponse creates a response to req marked as a network error, with msg as its body.
+func networkErrorResponse(req *http.Request, msg string) *http.Response {
+	body := fmt.Sprintf("%s\n\n%s %s: %s\n", http.StatusText(http.StatusBadGateway), req.Method, req.URL, msg)
+
+	return &http.Response{
+		Status:     http.StatusText(http.StatusBadGateway),
+		StatusCode: http.StatusBadGateway,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Content-Type":     {"text/plain; charset=utf-8"},
+			responseTypeHeader: {"error"},
+		},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// replayableBody keeps what's read from a request body, up to maxReplayedBodySize, so that it can be sent again after
+// a redirect. Closing it doesn't close the body, so that the rest can still be read for the next request. The body is
+// closed with its data channel.
+type replayableBody struct {
+	mu       sync.Mutex
+	r        io.Reader
+	buf      bytes.Buffer
+	eof      bool
+	overflow bool
+}
+
+func (b *replayableBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n, err := b.r.Read(p)
+	if !b.overflow {
+		if b.buf.Len()+n > maxReplayedBodySize {
+			b.overflow = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF {
+		b.eof = true
+	}
+
+	return n, err
+}
+
+func (b *replayableBody) Close() error {
+	return nil
+}
+
+// replay returns the whole body, after reading what's left of it, or false if it's too large to keep.
+func (b *replayableBody) replay() (io.ReadCloser, bool) {
+	b.mu.Lock()
+	eof := b.eof
+	b.mu.Unlock()
+
+	if !eof {
+		if _, err := io.Copy(io.Discard, b); err != nil {
+			return nil, false
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.overflow {
+		return nil, false
+	}
+
+	return io.NopCloser(bytes.NewReader(b.buf.Bytes())), true
+}
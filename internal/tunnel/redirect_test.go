@@ -0,0 +1,169 @@
+package tunnel
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// redirectTestHandler redirects /redirect/<status> to /echo, and /hops/<n> to /hops/<n-1> until /hops/0. /echo and
+// /hops/0 describe the request they get.
+func redirectTestHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/redirect/", func(w http.ResponseWriter, r *http.Request) {
+		status, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/redirect/"))
+		location := "/echo"
+		if to := r.URL.Query().Get("to"); to != "" {
+			location = to
+		}
+		http.Redirect(w, r, location, status)
+	})
+	mux.HandleFunc("/hops/", func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/hops/"))
+		if n > 0 {
+			http.Redirect(w, r, fmt.Sprintf("/hops/%d", n-1), http.StatusFound)
+			return
+		}
+		fmt.Fprint(w, "done")
+	})
+	mux.HandleFunc("/echo", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s body=%q type=%q auth=%q cookie=%q", r.Method, r.Host, body, r.Header.Get("Content-Type"),
+			r.Header.Get("Authorization"), r.Header.Get("Cookie"))
+	})
+
+	return mux
+}
+
+func testFetch(
+	t *testing.T,
+	client *http.Client,
+	method, rawURL, body string,
+	header http.Header,
+) (*http.Response, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, rawURL, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set(redirectModeHeader, redirectFollow)
+
+	resp := fetch(client, req)
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp, string(b)
+}
+
+func TestFetchRedirectMethods(t *testing.T) {
+	client := newHTTPClient(newHandlerTransport(redirectTestHandler()), nil)
+	header := http.Header{"Content-Type": {"text/plain"}}
+
+	for _, tc := range []struct {
+		status int
+		method string
+		want   string
+	}{
+		// POST becomes GET without a body for 301, 302, and 303.
+		{http.StatusMovedPermanently, http.MethodPost, `GET localhost body="" type=""`},
+		{http.StatusFound, http.MethodPost, `GET localhost body="" type=""`},
+		{http.StatusSeeOther, http.MethodPost, `GET localhost body="" type=""`},
+		// Other methods only become GET for 303.
+		{http.StatusMovedPermanently, http.MethodPut, `PUT localhost body="hello" type="text/plain"`},
+		{http.StatusFound, http.MethodPut, `PUT localhost body="hello" type="text/plain"`},
+		{http.StatusSeeOther, http.MethodPut, `GET localhost body="" type=""`},
+		{http.StatusSeeOther, http.MethodDelete, `GET localhost body="" type=""`},
+		// 307 and 308 keep the method and body.
+		{http.StatusTemporaryRedirect, http.MethodPost, `POST localhost body="hello" type="text/plain"`},
+		{http.StatusPermanentRedirect, http.MethodPost, `POST localhost body="hello" type="text/plain"`},
+	} {
+		target := fmt.Sprintf("http://localhost/redirect/%d", tc.status)
+		_, body := testFetch(t, client, tc.method, target, "hello", header)
+		if !strings.HasPrefix(body, tc.want+" ") {
+			t.Errorf("%s redirected by %d: got %s, want %s", tc.method, tc.status, body, tc.want)
+		}
+	}
+}
+
+func TestFetchRedirectLimit(t *testing.T) {
+	client := newHTTPClient(newHandlerTransport(redirectTestHandler()), nil)
+
+	resp, body := testFetch(t, client, http.MethodGet, fmt.Sprintf("http://localhost/hops/%d", maxRedirects), "", nil)
+	if resp.StatusCode != http.StatusOK || body != "done" {
+		t.Errorf("%d redirects: got %d %q", maxRedirects, resp.StatusCode, body)
+	}
+
+	resp, _ = testFetch(t, client, http.MethodGet, fmt.Sprintf("http://localhost/hops/%d", maxRedirects+1), "", nil)
+	if resp.StatusCode != http.StatusBadGateway || resp.Header.Get(responseTypeHeader) != "error" {
+		t.Errorf("%d redirects: got %d, want a network error", maxRedirects+1, resp.StatusCode)
+	}
+}
+
+func TestFetchRedirectCrossOrigin(t *testing.T) {
+	client := newHTTPClient(newHandlerTransport(redirectTestHandler()), nil)
+	header := http.Header{"Authorization": {"Bearer secret"}, "Cookie": {"a=1"}}
+
+	for to, want := range map[string]string{
+		"http://other.example/echo":  `auth="" cookie=""`,
+		"https://localhost/echo":     `auth="" cookie=""`,
+		"http://localhost:8080/echo": `auth="" cookie=""`,
+		// The default port doesn't change the origin.
+		"http://localhost:80/echo": `auth="Bearer secret" cookie="a=1"`,
+		"/echo":                    `auth="Bearer secret" cookie="a=1"`,
+	} {
+		target := "http://localhost/redirect/307?to=" + url.QueryEscape(to)
+		if _, body := testFetch(t, client, http.MethodGet, target, "", header); !strings.HasSuffix(body, want) {
+			t.Errorf("redirect to %s: got %s, want %s", to, body, want)
+		}
+	}
+}
+
+func TestFetchRedirectCookies(t *testing.T) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jar.SetCookies(&url.URL{Scheme: "http", Host: "localhost", Path: "/"}, []*http.Cookie{{Name: "b", Value: "2"}})
+	client := newHTTPClient(newHandlerTransport(redirectTestHandler()), jar)
+
+	// The jar's cookies are added to the caller's once per request, not once per redirect.
+	_, body := testFetch(t, client, http.MethodGet, "http://localhost/redirect/302", "", http.Header{"Cookie": {"a=1"}})
+	if want := `cookie="a=1; b=2"`; !strings.HasSuffix(body, want) {
+		t.Errorf("got %s, want %s", body, want)
+	}
+}
+
+func TestSameOrigin(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want bool
+	}{
+		{"http://example.com/a", "http://example.com/b", true},
+		{"http://example.com/", "http://EXAMPLE.com:80/", true},
+		{"https://example.com/", "https://example.com:443/", true},
+		{"http://[::1]/", "http://[::1]:80/", true},
+		{"http://example.com/", "https://example.com/", false},
+		{"http://example.com/", "http://example.com:443/", false},
+		{"http://example.com/", "http://example.com:8080/", false},
+		{"http://example.com/", "http://www.example.com/", false},
+	} {
+		a, _ := http.NewRequest(http.MethodGet, tc.a, nil)
+		b, _ := http.NewRequest(http.MethodGet, tc.b, nil)
+		if got := sameOrigin(a, b); got != tc.want {
+			t.Errorf("sameOrigin(%s, %s): got %t, want %t", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
@@ -1,24 +1,163 @@
 package tunnel
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
+	"log"
+	"net"
+	"net/http"
 	"net/http/httputil"
 	"net/url"
+
+	"golang.org/x/net/http2"
 )
 
-func newSingleHostReverseProxy(target *url.URL, changeHostHeader, changeOriginHeader bool) *httputil.ReverseProxy {
+// router reverse proxies requests to the target of the route with the longest prefix matching the request's path,
+// among the routes of the request's virtual host. File targets are served by staticHandler. Header rules rewrite the
+// requests to targets and every response.
+type router struct {
+	routes   *Routes
+	rules    HeaderRules
+	handlers map[string]http.Handler
+}
+
+func newRouter(routes *Routes, rules HeaderRules) *router {
+	handlers := make(map[string]http.Handler, len(routes.All()))
+	for _, route := range routes.All() {
+		if route.IsFile() {
+			handlers[route.String()] = newStaticHandler(route)
+		} else {
+			handlers[route.String()] = newSingleHostReverseProxy(route, rules)
+		}
+	}
+
+	return &router{
+		routes:   routes,
+		rules:    rules,
+		handlers: handlers,
+	}
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if rt.rules.hasResponseRules() {
+		w = &headerRewritingResponseWriter{ResponseWriter: w, req: r, rules: rt.rules}
+	}
+
+	vhost, ok := rt.routes.VirtualHost(r.Host)
+	if !ok {
+		status := rt.routes.UnknownHostStatus()
+		http.Error(w, fmt.Sprintf("%s: unknown host %s", http.StatusText(status), r.Host), status)
+		return
+	}
+
+	route, ok := rt.routes.Match(vhost, r.URL.Path)
+	if !ok {
+		http.Error(w, fmt.Sprintf("No route for %s%s", vhost, r.URL.Path), http.StatusNotFound)
+		return
+	}
+
+	rt.handlers[route.String()].ServeHTTP(w, r)
+}
+
+func newSingleHostReverseProxy(route Route, rules HeaderRules) *httputil.ReverseProxy {
+	target, _ := route.upstream()
+
+	var modifyResponse func(*http.Response) error
+	if route.RewriteURLs != "" {
+		modifyResponse = func(resp *http.Response) error {
+			rewriteURLs(route, resp)
+			return nil
+		}
+	}
+
 	return &httputil.ReverseProxy{
+		Transport:    newUpstreamTransport(route),
+		ErrorHandler: newProxyErrorHandler(route.Target),
 		Rewrite: func(r *httputil.ProxyRequest) {
+			if route.StripPrefix && route.Prefix != "/" {
+				r.Out.URL.Path = route.stripPrefix(r.Out.URL.Path)
+				if r.Out.URL.RawPath != "" {
+					r.Out.URL.RawPath = route.stripPrefix(r.Out.URL.RawPath)
+				}
+				r.Out.Header.Set("X-Forwarded-Prefix", route.Prefix)
+			}
+
 			r.SetURL(target)
 			r.SetXForwarded()
 
-			if !changeHostHeader {
+			if !route.ChangeHostHeader {
 				r.Out.Host = r.In.Host
 			}
 
-			if changeOriginHeader {
+			if route.ChangeOriginHeader {
 				r.Out.Header.Set("Origin", fmt.Sprintf("%s://%s", target.Scheme, target.Host))
 			}
+
+			rules.rewriteRequest(r.In, r.Out.Header)
+
+			if route.RewriteURLs != "" {
+				r.Out = r.Out.WithContext(withTunnelOrigin(r.Out.Context(), r.In))
+			}
 		},
+		ModifyResponse: modifyResponse,
+	}
+}
+
+// newUpstreamTransport creates the transport for requests to a route's target. Connections to unix targets are made to
+// the socket, and TLS connections use the route's TLS configuration.
+func newUpstreamTransport(route Route) http.RoundTripper {
+	target, socket := route.upstream()
+
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var d net.Dialer
+		if socket != "" {
+			return d.DialContext(ctx, "unix", socket)
+		}
+
+		return d.DialContext(ctx, network, addr)
+	}
+
+	if route.HTTP2 {
+		t := &http2.Transport{TLSClientConfig: route.tlsConfig}
+		if target.Scheme != "https" {
+			// h2c: HTTP/2 over cleartext, without upgrading from HTTP/1.1.
+			t.AllowHTTP = true
+			t.DialTLSContext = func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dial(ctx, network, addr)
+			}
+		}
+
+		return t
+	}
+
+	if socket == "" && route.tlsConfig == nil {
+		return http.DefaultTransport
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if socket != "" {
+		t.Proxy = nil
+		t.DialContext = dial
+	}
+	if route.tlsConfig != nil {
+		t.TLSClientConfig = route.tlsConfig
+	}
+
+	return t
+}
+
+// newProxyErrorHandler creates a proxy error handler that responds with a 502 page describing the error. TLS errors
+// come with a hint on how to fix them.
+func newProxyErrorHandler(target *url.URL) func(http.ResponseWriter, *http.Request, error) {
+	return func(w http.ResponseWriter, r *http.Request, err error) {
+		log.Printf("http: proxy error: %v", err)
+
+		msg := fmt.Sprintf("%s\n\nProxying to %s failed: %v", http.StatusText(http.StatusBadGateway), target.Redacted(), err)
+		if hint := tlsErrorHint(err); hint != "" {
+			msg += "\n\n" + hint
+		}
+
+		http.Error(w, msg, http.StatusBadGateway)
 	}
 }
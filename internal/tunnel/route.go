@@ -0,0 +1,433 @@
+package tunnel
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Route proxies requests to Host with paths under Prefix to Target.
+type Route struct {
+	// Host is the virtual host of the route, like "app.localhost". Routes without a host are the default virtual host.
+	// A host without a port matches any port.
+	Host string
+	// Prefix is a path prefix, like "/api". It matches the path itself and paths below it, like "/api/users", but not
+	// "/apiary".
+	Prefix string
+	// Target is the url requests are proxied to. A unix url, like "unix:///run/app.sock", proxies to a unix socket. Its
+	// path may be followed by a colon and an HTTP path, like "unix:///run/app.sock:/api". The HTTP path starts at the
+	// first colon followed by a slash. A file url, like "file:///srv/www" or "file:dist.zip", serves the files of a
+	// directory or zip/tar archive instead.
+	Target *url.URL
+
+	// StripPrefix removes Prefix from the path before proxying. It's implied for file targets.
+	StripPrefix        bool
+	ChangeHostHeader   bool
+	ChangeOriginHeader bool
+
+	// SPA serves the root index.html of a file target for paths that don't exist.
+	SPA bool
+	// ListDirectories serves listings of a file target's directories that don't have an index.html.
+	ListDirectories bool
+
+	// TLS configures connections to https targets.
+	TLS TLSOptions
+	// HTTP2 speaks HTTP/2 to the target: h2 for https targets, and h2c with prior knowledge for others.
+	HTTP2 bool
+	// RewriteURLs rewrites the target's absolute URLs in responses, to paths (RewriteURLsRelative) or to URLs of the
+	// tunnel's origin (RewriteURLsOrigin). If empty, URLs aren't rewritten.
+	RewriteURLs string
+
+	// files are the files of a file target, and tlsConfig is the TLS configuration of an https target. They're set by
+	// NewRoutes.
+	files     fs.FS
+	tlsConfig *tls.Config
+}
+
+// ParseRoute parses a route like "/api=http://localhost:8080,strip-prefix". The prefix may be preceded by a virtual
+// host, like "app.localhost/api", or be only a virtual host, like "app.localhost". Options follow the target,
+// separated by commas:
+//
+//   - strip-prefix, change-host-header, change-origin-header, http2, and rewrite-urls
+//   - for https targets, tls-ca, tls-insecure-skip-verify, tls-server-name, tls-cert, and tls-key
+//   - for file targets, spa and list-directories
+//
+// A boolean option may be given a value, like "change-host-header=false". rewrite-urls is relative, origin, or a
+// boolean, and is relative if given without a value. Other options require a value, like "tls-ca=ca.pem". Options not
+// given are taken from defaults.
+func ParseRoute(s string, defaults Route) (Route, error) {
+	hostPrefix, rest, ok := strings.Cut(s, "=")
+	if !ok {
+		return Route{}, fmt.Errorf("route %q: expected [host]prefix=target", s)
+	}
+
+	host, prefix := hostPrefix, "/"
+	if i := strings.Index(hostPrefix, "/"); i >= 0 {
+		host, prefix = hostPrefix[:i], hostPrefix[i:]
+	}
+
+	host, err := normalizeHost(host)
+	if err != nil {
+		return Route{}, fmt.Errorf("route %q: %w", s, err)
+	}
+
+	prefix, err = normalizePrefix(prefix)
+	if err != nil {
+		return Route{}, fmt.Errorf("route %q: %w", s, err)
+	}
+
+	options := strings.Split(rest, ",")
+
+	target, err := url.Parse(options[0])
+	if err != nil {
+		return Route{}, fmt.Errorf("route %q: %w", s, err)
+	}
+	switch target.Scheme {
+	case "file", "unix":
+		if localPath(target) == "" {
+			return Route{}, fmt.Errorf("route %q: %s target must have a path", s, target.Scheme)
+		}
+	default:
+		if target.Scheme == "" || target.Host == "" {
+			return Route{}, fmt.Errorf("route %q: target must be an absolute url", s)
+		}
+	}
+
+	r := defaults
+	r.Host = host
+	r.Prefix = prefix
+	r.Target = target
+
+	for _, option := range options[1:] {
+		name, value, hasValue := strings.Cut(option, "=")
+
+		if err := r.setOption(name, value, hasValue); err != nil {
+			return Route{}, fmt.Errorf("route %q: %w", s, err)
+		}
+	}
+
+	return r, nil
+}
+
+func (r *Route) setOption(name, value string, hasValue bool) error {
+	switch name {
+	case "tls-ca", "tls-server-name", "tls-cert", "tls-key":
+		if r.Target.Scheme != "https" {
+			return fmt.Errorf("option %s is only for https targets", name)
+		}
+		if value == "" {
+			return fmt.Errorf("option %s requires a value", name)
+		}
+
+		switch name {
+		case "tls-ca":
+			r.TLS.CAFile = value
+		case "tls-server-name":
+			r.TLS.ServerName = value
+		case "tls-cert":
+			r.TLS.CertFile = value
+		case "tls-key":
+			r.TLS.KeyFile = value
+		}
+
+		return nil
+	}
+
+	if name == "rewrite-urls" {
+		if r.IsFile() {
+			return fmt.Errorf("option %s isn't for file targets", name)
+		}
+
+		switch value {
+		case RewriteURLsRelative, RewriteURLsOrigin:
+			r.RewriteURLs = value
+			return nil
+		}
+	}
+
+	enabled := true
+	if hasValue {
+		var err error
+		enabled, err = strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("option %s: %w", name, err)
+		}
+	}
+
+	switch name {
+	case "strip-prefix":
+		r.StripPrefix = enabled
+	case "change-host-header":
+		r.ChangeHostHeader = enabled
+	case "change-origin-header":
+		r.ChangeOriginHeader = enabled
+	case "rewrite-urls":
+		r.RewriteURLs = ""
+		if enabled {
+			r.RewriteURLs = RewriteURLsRelative
+		}
+	case "http2":
+		if r.IsFile() {
+			return fmt.Errorf("option %s isn't for file targets", name)
+		}
+
+		r.HTTP2 = enabled
+	case "tls-insecure-skip-verify":
+		if r.Target.Scheme != "https" {
+			return fmt.Errorf("option %s is only for https targets", name)
+		}
+
+		r.TLS.InsecureSkipVerify = enabled
+	case "spa", "list-directories":
+		if !r.IsFile() {
+			return fmt.Errorf("option %s is only for file targets", name)
+		}
+
+		if name == "spa" {
+			r.SPA = enabled
+		} else {
+			r.ListDirectories = enabled
+		}
+	default:
+		return fmt.Errorf("unknown option %q", name)
+	}
+
+	return nil
+}
+
+// Matches reports whether path is under the route's prefix.
+func (r Route) Matches(path string) bool {
+	return hasPathPrefix(path, r.Prefix)
+}
+
+// stripPrefix removes the route's prefix from path if the route strips it.
+func (r Route) stripPrefix(path string) string {
+	if !r.StripPrefix || r.Prefix == "/" {
+		return path
+	}
+
+	path = strings.TrimPrefix(path, r.Prefix)
+	if path == "" {
+		path = "/"
+	}
+
+	return path
+}
+
+// IsFile reports whether the route serves files instead of proxying.
+func (r Route) IsFile() bool {
+	return r.Target.Scheme == "file"
+}
+
+// upstream returns the url requests are proxied to and, for unix targets, the path of the socket to dial. The url of
+// a unix target is an http url with the host localhost.
+func (r Route) upstream() (target *url.URL, socket string) {
+	if r.Target.Scheme != "unix" {
+		return r.Target, ""
+	}
+
+	// The socket's path may itself contain colons, so the HTTP path starts at the first colon followed by a slash.
+	socket, httpPath := localPath(r.Target), ""
+	if i := strings.Index(socket, ":/"); i >= 0 {
+		socket, httpPath = socket[:i], socket[i+1:]
+	}
+
+	return &url.URL{
+		Scheme:   "http",
+		Host:     "localhost",
+		Path:     httpPath,
+		RawQuery: r.Target.RawQuery,
+	}, socket
+}
+
+// String returns the route's host and prefix, like "app.localhost/api".
+func (r Route) String() string {
+	return r.Host + r.Prefix
+}
+
+// Routes selects routes by the virtual host and path of requests.
+type Routes struct {
+	// routes are ordered from the longest prefix to the shortest.
+	routes  []Route
+	hosts   map[string]struct{}
+	aliases map[string]string
+
+	unknownHostStatus int
+}
+
+// NewRoutes creates a set of routes. Each virtual host and prefix pair must be unique. aliases maps host aliases to
+// the virtual hosts of routes. Requests to hosts that aren't virtual hosts or aliases get the default virtual host's
+// routes if unknownHostStatus is 0, and a response with status unknownHostStatus otherwise.
+func NewRoutes(routes []Route, aliases map[string]string, unknownHostStatus int) (*Routes, error) {
+	rs := &Routes{
+		routes:            make([]Route, 0, len(routes)),
+		hosts:             make(map[string]struct{}),
+		aliases:           make(map[string]string, len(aliases)),
+		unknownHostStatus: unknownHostStatus,
+	}
+
+	keys := make(map[string]struct{}, len(routes))
+	for _, r := range routes {
+		host, err := normalizeHost(r.Host)
+		if err != nil {
+			return nil, err
+		}
+
+		prefix, err := normalizePrefix(r.Prefix)
+		if err != nil {
+			return nil, err
+		}
+
+		r.Host, r.Prefix = host, prefix
+		if _, ok := keys[r.String()]; ok {
+			return nil, fmt.Errorf("duplicate route for %s", r)
+		}
+		keys[r.String()] = struct{}{}
+
+		if r.IsFile() && r.files == nil {
+			r.files, err = openFiles(localPath(r.Target))
+			if err != nil {
+				return nil, fmt.Errorf("route %s: %w", r, err)
+			}
+		}
+		if r.Target.Scheme == "https" {
+			r.tlsConfig, err = r.TLS.config()
+			if err != nil {
+				return nil, fmt.Errorf("route %s: %w", r, err)
+			}
+		}
+
+		rs.routes = append(rs.routes, r)
+		rs.hosts[host] = struct{}{}
+	}
+
+	for alias, host := range aliases {
+		normalizedAlias, err := normalizeHost(alias)
+		if err != nil {
+			return nil, err
+		}
+
+		normalizedHost, err := normalizeHost(host)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := rs.hosts[normalizedHost]; !ok || normalizedHost == "" {
+			return nil, fmt.Errorf("alias %s: no routes for virtual host %q", alias, host)
+		}
+		if _, ok := rs.hosts[normalizedAlias]; ok {
+			return nil, fmt.Errorf("alias %s: already a virtual host", alias)
+		}
+
+		rs.aliases[normalizedAlias] = normalizedHost
+	}
+
+	sort.SliceStable(rs.routes, func(i, j int) bool {
+		return len(rs.routes[i].Prefix) > len(rs.routes[j].Prefix)
+	})
+
+	return rs, nil
+}
+
+// All returns the routes.
+func (rs *Routes) All() []Route {
+	return rs.routes
+}
+
+// VirtualHost returns the virtual host of requests to host. The default virtual host is "". ok is false if host is
+// unknown and unknown hosts aren't given the default virtual host.
+func (rs *Routes) VirtualHost(host string) (vhost string, ok bool) {
+	host = strings.ToLower(host)
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+
+	for _, h := range []string{host, hostname} {
+		if _, ok := rs.hosts[h]; ok && h != "" {
+			return h, true
+		}
+		if vhost, ok := rs.aliases[h]; ok {
+			return vhost, true
+		}
+	}
+
+	return "", rs.unknownHostStatus == 0
+}
+
+// UnknownHostStatus is the status of responses to requests to unknown hosts, or 0 if they're given the default
+// virtual host.
+func (rs *Routes) UnknownHostStatus() int {
+	return rs.unknownHostStatus
+}
+
+// Match returns the route of vhost with the longest prefix matching path.
+func (rs *Routes) Match(vhost, path string) (Route, bool) {
+	for _, r := range rs.routes {
+		if r.Host == vhost && r.Matches(path) {
+			return r, true
+		}
+	}
+
+	return Route{}, false
+}
+
+// localPath returns the path of a file url. Relative paths, like "file:dist", are opaque.
+func localPath(u *url.URL) string {
+	if u.Opaque != "" {
+		return u.Opaque
+	}
+
+	return u.Path
+}
+
+// normalizeHost lowercases host and checks that it's a valid host or host:port.
+func normalizeHost(host string) (string, error) {
+	if host == "" {
+		return "", nil
+	}
+
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	if hostname == "" || strings.ContainsAny(hostname, "/?#@ ") {
+		return "", fmt.Errorf("invalid host %q", host)
+	}
+
+	return strings.ToLower(host), nil
+}
+
+// hasPathPrefix reports whether path is prefix or below it. prefix must be normalized.
+func hasPathPrefix(path, prefix string) bool {
+	if prefix == "/" {
+		return true
+	}
+
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+
+	return len(path) == len(prefix) || path[len(prefix)] == '/'
+}
+
+// normalizePrefix checks that prefix is an absolute path and removes any trailing slash.
+func normalizePrefix(prefix string) (string, error) {
+	if !strings.HasPrefix(prefix, "/") {
+		return "", fmt.Errorf("prefix %q must start with /", prefix)
+	}
+
+	if prefix != "/" {
+		prefix = strings.TrimRight(prefix, "/")
+		if prefix == "" {
+			prefix = "/"
+		}
+	}
+
+	return prefix, nil
+}
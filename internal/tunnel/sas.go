@@ -0,0 +1,181 @@
+package tunnel
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// sasNonceSize is the size of the server's nonce in the short authentication string exchange, in bytes.
+const sasNonceSize = 32
+
+type controlSASCommit struct {
+	// Commitment is the base64-encoded SHA-256 of the client's nonce.
+	Commitment string `json:"commitment"`
+}
+
+type controlSASNonce struct {
+	Nonce string `json:"nonce"`
+}
+
+// sasExchange derives a tunnel's short authentication string from the DTLS fingerprints of both peers and a nonce from
+// each. Like in ZRTP, the client commits to its nonce before the server sends its own, and reveals it after. A server
+// in the middle has to pick its nonce on one side before it knows the client's, so it can't make the strings on both
+// sides match, other than by chance. Fingerprints alone wouldn't do: it sees the client's before it has to pick its
+// certificate, and could generate certificates until the strings match. Each tunnel has a single exchange.
+type sasExchange struct {
+	serverFingerprint string
+	clientFingerprint string
+
+	mu          sync.Mutex
+	commitment  string
+	serverNonce string
+	done        bool
+}
+
+// newSASExchange returns the short authentication string exchange of t, whose offer must be registered.
+func newSASExchange(t *Tunnel) (*sasExchange, error) {
+	local, remote := t.pc.LocalDescription(), t.pc.RemoteDescription()
+	if local == nil || remote == nil {
+		return nil, errors.New("offer isn't registered")
+	}
+
+	serverFingerprint, err := sdpFingerprint(local.SDP)
+	if err != nil {
+		return nil, fmt.Errorf("answer: %w", err)
+	}
+	clientFingerprint, err := sdpFingerprint(remote.SDP)
+	if err != nil {
+		return nil, fmt.Errorf("offer: %w", err)
+	}
+
+	return &sasExchange{serverFingerprint: serverFingerprint, clientFingerprint: clientFingerprint}, nil
+}
+
+// commit records the client's commitment and returns the server's nonce.
+func (e *sasExchange) commit(commitment string) (string, error) {
+	if commitment == "" {
+		return "", errors.New("commitment is empty")
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.commitment != "" {
+		return "", errors.New("short authentication string exchange already started")
+	}
+
+	b := make([]byte, sasNonceSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	e.commitment = commitment
+	e.serverNonce = base64.StdEncoding.EncodeToString(b)
+
+	return e.serverNonce, nil
+}
+
+// reveal checks the client's nonce against its commitment and returns the short authentication string. It may only be
+// called once, whether it fails or not.
+func (e *sasExchange) reveal(clientNonce string) (string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	switch {
+	case e.commitment == "":
+		return "", errors.New("no commitment")
+	case e.done:
+		return "", errors.New("short authentication string exchange already finished")
+	}
+	e.done = true
+
+	if sasCommitment(clientNonce) != e.commitment {
+		return "", errors.New("nonce doesn't match commitment")
+	}
+
+	return shortAuthString(e.serverFingerprint, e.clientFingerprint, clientNonce, e.serverNonce), nil
+}
+
+// handleSASMessages registers handlers for the short authentication string messages of c. sasCommit is answered by
+// sasNonce, and onSAS is called with the string once the client sends sasReveal. e is nil if the string can't be
+// derived, in which case the messages are answered by errors.
+func handleSASMessages(c *ControlDataChannel, e *sasExchange, onSAS func(sas string)) {
+	c.handle("sasCommit", func(message controlMessage) error {
+		if e == nil {
+			return errors.New("short authentication string can't be derived")
+		}
+
+		var commit controlSASCommit
+		if err := json.Unmarshal(message.Data, &commit); err != nil {
+			return err
+		}
+		nonce, err := e.commit(commit.Commitment)
+		if err != nil {
+			return err
+		}
+
+		return c.send(message.ID, "sasNonce", controlSASNonce{Nonce: nonce})
+	})
+	c.handle("sasReveal", func(message controlMessage) error {
+		if e == nil {
+			return errors.New("short authentication string can't be derived")
+		}
+
+		var reveal controlSASNonce
+		if err := json.Unmarshal(message.Data, &reveal); err != nil {
+			return err
+		}
+		sas, err := e.reveal(reveal.Nonce)
+		if err != nil {
+			return err
+		}
+		onSAS(sas)
+
+		return nil
+	})
+}
+
+// sasCommitment returns the commitment to nonce: its base64-encoded SHA-256.
+func sasCommitment(nonce string) string {
+	sum := sha256.Sum256([]byte(nonce))
+
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// shortAuthString derives a short authentication string from the SHA-256 of the server's and the client's
+// fingerprints, the client's nonce, and the server's, separated by newlines. It's the first four bytes of the hash, as
+// a big endian integer, modulo a million, formatted like "012 345".
+func shortAuthString(serverFingerprint, clientFingerprint, clientNonce, serverNonce string) string {
+	sum := sha256.Sum256([]byte(serverFingerprint + "\n" + clientFingerprint + "\n" + clientNonce + "\n" + serverNonce))
+	n := binary.BigEndian.Uint32(sum[:4]) % 1_000_000
+
+	return fmt.Sprintf("%03d %03d", n/1000, n%1000)
+}
+
+// sdpFingerprint returns the SHA-256 DTLS fingerprint in sdp, in upper case, like "AB:CD:...".
+func sdpFingerprint(sdp string) (string, error) {
+	for _, line := range strings.Split(sdp, "\n") {
+		value, ok := strings.CutPrefix(strings.TrimSpace(line), "a=fingerprint:")
+		if !ok {
+			continue
+		}
+
+		algorithm, fingerprint, ok := strings.Cut(value, " ")
+		if ok && strings.EqualFold(algorithm, "sha-256") {
+			return strings.ToUpper(strings.TrimSpace(fingerprint)), nil
+		}
+	}
+
+	return "", errors.New("no sha-256 fingerprint")
+}
+
+// sameSAS reports whether a and b are the same short authentication string, ignoring spaces.
+func sameSAS(a, b string) bool {
+	return strings.ReplaceAll(a, " ", "") == strings.ReplaceAll(b, " ", "")
+}
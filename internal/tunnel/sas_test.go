@@ -0,0 +1,56 @@
+package tunnel
+
+import "testing"
+
+func TestSASExchange(t *testing.T) {
+	e := &sasExchange{serverFingerprint: "AB:CD", clientFingerprint: "EF:01"}
+
+	if _, err := e.reveal("client nonce"); err == nil {
+		t.Error("reveal before commit succeeded")
+	}
+
+	serverNonce, err := e.commit(sasCommitment("client nonce"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The client can't restart the exchange to get another nonce from the server.
+	if _, err := e.commit(sasCommitment("other nonce")); err == nil {
+		t.Error("second commit succeeded")
+	}
+
+	sas, err := e.reveal("client nonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := shortAuthString("AB:CD", "EF:01", "client nonce", serverNonce); sas != want {
+		t.Errorf("got %q, want %q", sas, want)
+	}
+	if _, err := e.reveal("client nonce"); err == nil {
+		t.Error("second reveal succeeded")
+	}
+}
+
+func TestSASExchangeWrongNonce(t *testing.T) {
+	e := &sasExchange{serverFingerprint: "AB:CD", clientFingerprint: "EF:01"}
+
+	if _, err := e.commit(sasCommitment("client nonce")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.reveal("other nonce"); err == nil {
+		t.Error("reveal of another nonce succeeded")
+	}
+	// The exchange is over, so the client can't try other nonces.
+	if _, err := e.reveal("client nonce"); err == nil {
+		t.Error("reveal after a failed one succeeded")
+	}
+}
+
+func TestShortAuthString(t *testing.T) {
+	// The tunnel page derives the same string from the same inputs.
+	if got, want := shortAuthString("AB:CD", "EF:01", "Y2xpZW50", "c2VydmVy"), "924 445"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := sasCommitment("client nonce"), "SR7gI3NXWpHVe8I2AUJnsSLAADcUgHOsLCEfbM4JZxg="; got != want {
+		t.Errorf("got commitment %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,308 @@
+package tunnel
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const staticIndexFile = "index.html"
+
+// openFiles opens the directory or zip/tar archive at name. Archives are read into memory. If an archive's only
+// top-level entry is a directory, like "dist/", that directory is its root.
+func openFiles(name string) (fs.FS, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return newDirFS(name)
+	}
+
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var files fs.FS
+	switch lower := strings.ToLower(name); {
+	case strings.HasSuffix(lower, ".zip"):
+		files, err = zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	case strings.HasSuffix(lower, ".tar"):
+		files, err = tarToZip(bytes.NewReader(data))
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		var zr *gzip.Reader
+		zr, err = gzip.NewReader(bytes.NewReader(data))
+		if err == nil {
+			files, err = tarToZip(zr)
+		}
+	default:
+		return nil, fmt.Errorf("%s: not a directory or .zip, .tar, .tar.gz, or .tgz archive", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	entries, err := fs.ReadDir(files, ".")
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if len(entries) == 1 && entries[0].IsDir() {
+		return fs.Sub(files, entries[0].Name())
+	}
+
+	return files, nil
+}
+
+// dirFS is like os.DirFS, but doesn't open files through symlinks that lead outside the directory, so that a link in
+// it can't expose other files.
+type dirFS struct {
+	// root is the directory's absolute path, with symlinks resolved.
+	root  string
+	files fs.FS
+}
+
+func newDirFS(dir string) (*dirFS, error) {
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if root, err = filepath.EvalSymlinks(root); err != nil {
+		return nil, err
+	}
+
+	return &dirFS{root: root, files: os.DirFS(root)}, nil
+}
+
+func (d *dirFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	resolved, err := filepath.EvalSymlinks(filepath.Join(d.root, filepath.FromSlash(name)))
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	rel, err := filepath.Rel(d.root, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	return d.files.Open(filepath.ToSlash(rel))
+}
+
+// tarToZip repacks a tar archive as an uncompressed zip archive in memory, so that archive/zip's fs.FS can serve it.
+// Entries other than regular files and directories, and entries outside the archive's root, are skipped.
+func tarToZip(r io.Reader) (*zip.Reader, error) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		name := path.Clean(strings.TrimLeft(hdr.Name, "/"))
+		if name == "." || name == ".." || strings.HasPrefix(name, "../") {
+			continue
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if _, err := zw.CreateHeader(&zip.FileHeader{Name: name + "/", Modified: hdr.ModTime}); err != nil {
+				return nil, err
+			}
+
+		case tar.TypeReg:
+			w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: hdr.ModTime})
+			if err != nil {
+				return nil, err
+			}
+			if _, err := io.Copy(w, tr); err != nil {
+				return nil, err
+			}
+
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	return zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+}
+
+// staticHandler serves files for a route. The route's prefix is always removed from the path. Directories are served
+// by their index.html, by a listing if listDirectories is set, or not at all. If spa is set, paths that don't exist
+// are served the root index.html, so that a single-page app can route them.
+type staticHandler struct {
+	prefix string
+	files  fs.FS
+
+	spa             bool
+	listDirectories bool
+}
+
+func newStaticHandler(route Route) *staticHandler {
+	prefix := route.Prefix
+	if prefix == "/" {
+		prefix = ""
+	}
+
+	return &staticHandler{
+		prefix:          prefix,
+		files:           route.files,
+		spa:             route.SPA,
+		listDirectories: route.ListDirectories,
+	}
+}
+
+func (h *staticHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := path.Clean("/" + strings.TrimPrefix(r.URL.Path, h.prefix))
+
+	err := h.serve(w, r, name)
+	if errors.Is(err, fs.ErrNotExist) && h.spa {
+		err = h.serveFile(w, r, staticIndexFile)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		case errors.Is(err, fs.ErrPermission):
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		default:
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+	}
+}
+
+// serve serves the file or directory at name, an absolute slash-separated path.
+func (h *staticHandler) serve(w http.ResponseWriter, r *http.Request, name string) error {
+	fsName := strings.TrimPrefix(name, "/")
+	if fsName == "" {
+		fsName = "."
+	}
+
+	info, err := fs.Stat(h.files, fsName)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		return h.serveFile(w, r, fsName)
+	}
+
+	// Relative URLs in a directory's index are resolved against the directory's URL, which must end with a slash.
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		location := path.Base(r.URL.Path) + "/"
+		if r.URL.RawQuery != "" {
+			location += "?" + r.URL.RawQuery
+		}
+
+		http.Redirect(w, r, location, http.StatusMovedPermanently)
+		return nil
+	}
+
+	if err := h.serveFile(w, r, path.Join(fsName, staticIndexFile)); !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	if !h.listDirectories {
+		return fs.ErrNotExist
+	}
+
+	return h.serveListing(w, r, fsName)
+}
+
+// serveFile serves the regular file at fsName. Validators are set so that conditional and range requests are
+// handled by http.ServeContent.
+func (h *staticHandler) serveFile(w http.ResponseWriter, r *http.Request, fsName string) error {
+	f, err := h.files.Open(fsName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fs.ErrNotExist
+	}
+
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		// Files in archives can't seek.
+		data, err := io.ReadAll(f)
+		if err != nil {
+			return err
+		}
+
+		content = bytes.NewReader(data)
+	}
+
+	w.Header().Set("ETag", fmt.Sprintf(`W/"%x-%x"`, info.ModTime().UnixNano(), info.Size()))
+	http.ServeContent(w, r, info.Name(), info.ModTime(), content)
+
+	return nil
+}
+
+func (h *staticHandler) serveListing(w http.ResponseWriter, r *http.Request, fsName string) error {
+	entries, err := fs.ReadDir(h.files, fsName)
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "<!doctype html>\n<meta name=\"viewport\" content=\"width=device-width\">\n")
+	fmt.Fprintf(&b, "<title>%s</title>\n<pre>\n", html.EscapeString(r.URL.Path))
+	if fsName != "." {
+		fmt.Fprintf(&b, "<a href=\"../\">../</a>\n")
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			name += "/"
+		}
+
+		href := url.URL{Path: name}
+		fmt.Fprintf(&b, "<a href=\"%s\">%s</a>\n", html.EscapeString(href.String()), html.EscapeString(name))
+	}
+	fmt.Fprintf(&b, "</pre>\n")
+
+	if r.Method != http.MethodHead {
+		_, _ = io.WriteString(w, b.String())
+	}
+
+	return nil
+}
@@ -0,0 +1,52 @@
+package tunnel
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStaticSymlinks(t *testing.T) {
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "page.txt"), []byte("page"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for link, target := range map[string]string{
+		"inside.txt":  "page.txt",
+		"secret.txt":  filepath.Join(outside, "secret.txt"),
+		"relative":    filepath.Join("..", filepath.Base(outside)),
+		"outside-dir": outside,
+	} {
+		if err := os.Symlink(target, filepath.Join(dir, link)); err != nil {
+			t.Skipf("symlinks aren't supported: %v", err)
+		}
+	}
+
+	files, err := openFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newStaticHandler(Route{Prefix: "/", files: files})
+
+	for path, want := range map[string]int{
+		"/page.txt":               http.StatusOK,
+		"/inside.txt":             http.StatusOK,
+		"/secret.txt":             http.StatusNotFound,
+		"/relative/secret.txt":    http.StatusNotFound,
+		"/outside-dir/secret.txt": http.StatusNotFound,
+		"/outside-dir/":           http.StatusNotFound,
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != want {
+			t.Errorf("%s: got %d, want %d", path, w.Code, want)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+const tcpDialTimeout = 10 * time.Second
+
+// TCPHandler handles tcp data channels.
+type TCPHandler struct {
+	Allowlist   Allowlist
+	FlowControl FlowControl
+}
+
+func (h *TCPHandler) HandleDataChannel(ctx context.Context, dc *webrtc.DataChannel, client ClientInfo) {
+	tdc := NewTCPDataChannel(ctx, h.Allowlist, dc, h.FlowControl)
+	go tdc.Run()
+}
+
+// TCPDataChannel forwards a TCP connection. The target host:port is named by the label (tcp:host:port) or, if the
+// label is just tcp, by the first message. Other messages are the stream's bytes. An empty message marks the end of
+// a direction, like a TCP half-close.
+type TCPDataChannel struct {
+	log *log.Logger
+
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+
+	allowlist Allowlist
+	dc        *webrtc.DataChannel
+	fc        *flowController
+
+	target    string
+	targets   chan string
+	hasTarget bool
+
+	r *io.PipeReader
+	w *io.PipeWriter
+}
+
+func NewTCPDataChannel(
+	ctx context.Context,
+	allowlist Allowlist,
+	dc *webrtc.DataChannel,
+	flowControl FlowControl,
+) *TCPDataChannel {
+	r, w := io.Pipe()
+	ctx, cancel := context.WithCancelCause(ctx)
+
+	t := &TCPDataChannel{
+		log:       log.New(os.Stderr, fmt.Sprintf("[TCP Data Channel %d] ", *dc.ID()), log.LstdFlags),
+		ctx:       ctx,
+		cancel:    cancel,
+		allowlist: allowlist,
+		dc:        dc,
+		fc:        newFlowController(dc, flowControl),
+		targets:   make(chan string, 1),
+		r:         r,
+		w:         w,
+	}
+
+	if target, ok := strings.CutPrefix(dc.Label(), "tcp:"); ok {
+		t.target = target
+		t.hasTarget = true
+	}
+
+	dc.OnMessage(t.onMessage)
+	dc.OnClose(t.onClose)
+
+	return t
+}
+
+// Run dials the target and copies bytes in both directions until both directions are done.
+func (t *TCPDataChannel) Run() {
+	defer t.dc.Close()
+	defer t.r.CloseWithError(errExchangeDone)
+
+	target := t.target
+	if target == "" {
+		select {
+		case target = <-t.targets:
+		case <-t.ctx.Done():
+			return
+		}
+	}
+
+	if !t.allowlist.Allows(target) {
+		t.log.Printf("Rejected %s. Not allowed.", target)
+		return
+	}
+
+	t.log.Printf("Dialing %s...", target)
+
+	d := net.Dialer{Timeout: tcpDialTimeout}
+	conn, err := d.DialContext(t.ctx, "tcp", target)
+	if err != nil {
+		t.log.Printf("Failed to dial %s: %v", target, err)
+		return
+	}
+	defer conn.Close()
+
+	stop := context.AfterFunc(t.ctx, func() {
+		_ = conn.Close()
+	})
+	defer stop()
+
+	t.log.Printf("Connected to %s", target)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		if _, err := io.Copy(conn, t.r); err != nil {
+			if t.ctx.Err() == nil {
+				t.log.Printf("Failed to write to %s: %v", target, err)
+			}
+
+			_ = conn.Close()
+			return
+		}
+
+		if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+			_ = cw.CloseWrite()
+		}
+	}()
+
+	buf := make([]byte, mtu)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			if err := t.fc.Send(buf[:n]); err != nil {
+				t.log.Printf("Failed to send: %v", err)
+
+				_ = conn.Close()
+				break
+			}
+		}
+
+		if err == io.EOF {
+			if err := t.fc.Send(nil); err != nil {
+				t.log.Printf("Failed to send: %v", err)
+			}
+			break
+		} else if err != nil {
+			if t.ctx.Err() == nil {
+				t.log.Printf("Failed to read from %s: %v", target, err)
+			}
+			break
+		}
+	}
+
+	wg.Wait()
+
+	t.log.Printf("Closed %s", target)
+}
+
+func (t *TCPDataChannel) onMessage(msg webrtc.DataChannelMessage) {
+	if !t.hasTarget {
+		t.hasTarget = true
+		t.targets <- string(msg.Data)
+		return
+	}
+
+	if len(msg.Data) == 0 {
+		_ = t.w.Close()
+		return
+	}
+
+	if _, err := t.w.Write(msg.Data); err != nil {
+		if errors.Is(err, errExchangeDone) {
+			return
+		}
+
+		t.log.Printf("Failed to write message data: %v", err)
+
+		_ = t.dc.Close()
+		return
+	}
+}
+
+func (t *TCPDataChannel) onClose() {
+	t.cancel(errDataChannelClosed)
+	t.fc.Close()
+	_ = t.w.CloseWithError(errDataChannelClosed)
+}
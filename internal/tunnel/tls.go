@@ -0,0 +1,106 @@
+package tunnel
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// TLSOptions configure connections to https targets.
+type TLSOptions struct {
+	// CAFile is a PEM bundle of certificate authorities trusted in addition to the system's, like mkcert's rootCA.pem.
+	CAFile string
+	// InsecureSkipVerify accepts any certificate.
+	InsecureSkipVerify bool
+	// ServerName is sent with SNI and verified against the certificate instead of the target's host.
+	ServerName string
+	// CertFile and KeyFile are a PEM certificate and key presented to targets that require client certificates.
+	CertFile string
+	KeyFile  string
+}
+
+// config creates the TLS configuration, or returns nil if the options are the defaults.
+func (o TLSOptions) config() (*tls.Config, error) {
+	if o == (TLSOptions{}) {
+		return nil, nil
+	}
+
+	c := &tls.Config{
+		ServerName:         o.ServerName,
+		InsecureSkipVerify: o.InsecureSkipVerify,
+	}
+
+	if o.CAFile != "" {
+		pem, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no PEM certificates", o.CAFile)
+		}
+
+		c.RootCAs = pool
+	}
+
+	if o.CertFile != "" || o.KeyFile != "" {
+		if o.CertFile == "" || o.KeyFile == "" {
+			return nil, errors.New("a client certificate requires both tls-cert and tls-key")
+		}
+
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		c.Certificates = []tls.Certificate{cert}
+	}
+
+	return c, nil
+}
+
+// tlsErrorHint explains how to fix a failed TLS connection to a target, or returns "" if err isn't a TLS error.
+func tlsErrorHint(err error) string {
+	var (
+		unknownAuthorityErr x509.UnknownAuthorityError
+		hostnameErr         x509.HostnameError
+		invalidErr          x509.CertificateInvalidError
+		recordHeaderErr     tls.RecordHeaderError
+	)
+
+	switch {
+	case errors.As(err, &unknownAuthorityErr):
+		return "The target's certificate isn't signed by a trusted authority. Trust its CA with the tls-ca option, " +
+			"or disable verification with the tls-insecure-skip-verify option."
+	case errors.As(err, &hostnameErr):
+		return "The target's certificate isn't valid for the target's host. Set the name to verify with the " +
+			"tls-server-name option."
+	case errors.As(err, &invalidErr):
+		return "The target's certificate is invalid (" + invalidErr.Error() + ")."
+	case errors.As(err, &recordHeaderErr):
+		return "The target didn't respond with TLS. Is it an http target?"
+	}
+
+	// Alerts sent by the target aren't exported as a type.
+	if msg := err.Error(); strings.Contains(msg, "remote error: tls:") {
+		if strings.Contains(msg, "certificate required") || strings.Contains(msg, "bad certificate") {
+			return "The target requires a client certificate. Set one with the tls-cert and tls-key options."
+		}
+
+		return "The target rejected the TLS handshake."
+	}
+
+	var verificationErr *tls.CertificateVerificationError
+	if errors.As(err, &verificationErr) {
+		return "The target's certificate couldn't be verified."
+	}
+
+	return ""
+}
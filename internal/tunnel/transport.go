@@ -0,0 +1,280 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// handlerTransport is an http.RoundTripper that serves requests with an http.Handler. Responses are streamed: the
+// response is returned as soon as the handler writes its header, and the body is delivered as the handler writes it.
+type handlerTransport struct {
+	handler http.Handler
+}
+
+func newHandlerTransport(handler http.Handler) http.RoundTripper {
+	return &handlerTransport{handler: handler}
+}
+
+func (ht *handlerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	pr, pw := io.Pipe()
+	rw := newStreamingResponseWriter(req, pr, pw)
+
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				// httputil.ReverseProxy panics with http.ErrAbortHandler when copying the body fails.
+				err, ok := r.(error)
+				if !ok {
+					err = fmt.Errorf("handler panic: %v", r)
+				}
+
+				rw.abort(err)
+				return
+			}
+
+			rw.finish()
+		}()
+
+		ht.handler.ServeHTTP(rw, req)
+	}()
+
+	select {
+	case resp := <-rw.resp:
+		// Streamed responses, like Server-Sent Events, may never end on their own. Stop waiting on the body once the
+		// request is canceled.
+		context.AfterFunc(req.Context(), func() {
+			_ = pr.CloseWithError(req.Context().Err())
+		})
+
+		return resp, nil
+
+	case err := <-rw.err:
+		return nil, err
+
+	case <-req.Context().Done():
+		_ = pr.CloseWithError(req.Context().Err())
+
+		return nil, req.Context().Err()
+
+	}
+}
+
+// streamingResponseWriter is an http.ResponseWriter that sends its response over a channel as soon as the header is
+// written. Body writes are buffered up to mtu bytes and piped to the response body on Flush or when the buffer fills.
+type streamingResponseWriter struct {
+	req *http.Request
+
+	header http.Header
+
+	pr *io.PipeReader
+	pw *io.PipeWriter
+	bw *bufio.Writer
+
+	mu          sync.Mutex
+	wroteHeader bool
+	// eventStream is set for Server-Sent Events responses. Each write is flushed so that events aren't delayed.
+	eventStream bool
+	// trailerKeys are the trailers declared by the Trailer header. trailer is set once the handler returns.
+	trailerKeys []string
+	trailer     http.Header
+
+	resp chan *http.Response
+	err  chan error
+}
+
+func newStreamingResponseWriter(req *http.Request, pr *io.PipeReader, pw *io.PipeWriter) *streamingResponseWriter {
+	return &streamingResponseWriter{
+		req:    req,
+		header: make(http.Header),
+		pr:     pr,
+		pw:     pw,
+		bw:     bufio.NewWriterSize(pw, mtu),
+		resp:   make(chan *http.Response, 1),
+		err:    make(chan error, 1),
+	}
+}
+
+func (w *streamingResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *streamingResponseWriter) WriteHeader(code int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.writeHeader(code)
+}
+
+func (w *streamingResponseWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.wroteHeader {
+		if w.header.Get("Content-Type") == "" && w.header.Get("Transfer-Encoding") == "" {
+			w.header.Set("Content-Type", http.DetectContentType(p))
+		}
+
+		w.writeHeader(http.StatusOK)
+	}
+
+	n, err := w.bw.Write(p)
+	if err != nil {
+		return n, err
+	}
+
+	if w.eventStream {
+		return n, w.bw.Flush()
+	}
+
+	return n, nil
+}
+
+func (w *streamingResponseWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.wroteHeader {
+		w.writeHeader(http.StatusOK)
+	}
+
+	_ = w.bw.Flush()
+}
+
+func (w *streamingResponseWriter) writeHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+
+	// Informational responses other than 101 Switching Protocols can't be relayed, so they're dropped.
+	if code >= 100 && code <= 199 && code != http.StatusSwitchingProtocols {
+		return
+	}
+
+	w.wroteHeader = true
+
+	header := w.header.Clone()
+
+	if mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type")); err == nil {
+		w.eventStream = mediaType == "text/event-stream"
+	}
+
+	contentLength := int64(-1)
+	if cl := header.Get("Content-Length"); cl != "" {
+		if n, err := strconv.ParseInt(textproto.TrimString(cl), 10, 64); err == nil && n >= 0 {
+			contentLength = n
+		}
+	}
+
+	// Like http.Transport, the trailer initially has a nil value for each declared key, and the values are set once
+	// the body has been read.
+	trailer := make(http.Header)
+	for _, v := range header.Values("Trailer") {
+		for _, key := range strings.Split(v, ",") {
+			if key = http.CanonicalHeaderKey(textproto.TrimString(key)); key != "" {
+				w.trailerKeys = append(w.trailerKeys, key)
+				trailer[key] = nil
+			}
+		}
+	}
+	header.Del("Trailer")
+
+	resp := &http.Response{
+		Status:        fmt.Sprintf("%03d %s", code, http.StatusText(code)),
+		StatusCode:    code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		ContentLength: contentLength,
+		Trailer:       trailer,
+		Request:       w.req,
+	}
+	resp.Body = &trailerReader{PipeReader: w.pr, w: w, resp: resp}
+
+	w.resp <- resp
+}
+
+// finish completes the response after the handler returns.
+func (w *streamingResponseWriter) finish() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.wroteHeader {
+		w.writeHeader(http.StatusOK)
+	}
+
+	if err := w.bw.Flush(); err != nil {
+		_ = w.pw.CloseWithError(err)
+		return
+	}
+
+	// Trailers are the declared keys of the header, and keys set with http.TrailerPrefix once the handler returns.
+	w.trailer = make(http.Header)
+	for _, key := range w.trailerKeys {
+		if values, ok := w.header[key]; ok {
+			w.trailer[key] = values
+		}
+	}
+	for key, values := range w.header {
+		if strings.HasPrefix(key, http.TrailerPrefix) {
+			w.trailer[http.CanonicalHeaderKey(strings.TrimPrefix(key, http.TrailerPrefix))] = values
+		}
+	}
+
+	_ = w.pw.Close()
+}
+
+// setTrailer sets the values of the response's trailer. It's called once the body has been read.
+func (w *streamingResponseWriter) setTrailer(trailer http.Header) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for key, values := range w.trailer {
+		trailer[key] = values
+	}
+}
+
+// abort fails the response. If the header hasn't been written, the round trip fails with err. Otherwise, the response
+// body fails with err.
+func (w *streamingResponseWriter) abort(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.err <- err
+	}
+
+	if errors.Is(err, http.ErrAbortHandler) {
+		err = io.ErrUnexpectedEOF
+	}
+
+	_ = w.pw.CloseWithError(err)
+}
+
+// trailerReader is a response body that sets the response's trailer when it reaches EOF. The trailer is set by the
+// reader, like http.Transport's bodies do, so that it's safe to read after the body without further synchronization.
+type trailerReader struct {
+	*io.PipeReader
+
+	w    *streamingResponseWriter
+	resp *http.Response
+}
+
+func (r *trailerReader) Read(p []byte) (int, error) {
+	n, err := r.PipeReader.Read(p)
+	if err == io.EOF {
+		r.w.setTrailer(r.resp.Trailer)
+	}
+
+	return n, err
+}
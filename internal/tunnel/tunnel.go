@@ -1,26 +1,38 @@
 package tunnel
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"net/http/cookiejar"
 	"os"
 
 	"github.com/pion/webrtc/v4"
 )
 
+var (
+	errTunnelClosed      = errors.New("tunnel closed")
+	errDataChannelClosed = errors.New("data channel closed")
+)
+
 type Tunnel struct {
 	log *log.Logger
 
-	client *http.Client
-	pc     *webrtc.PeerConnection
+	// ctx is canceled when the peer connection fails or closes. Data channel handlers derive their contexts from it.
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+
+	client  ClientInfo
+	pc      *webrtc.PeerConnection
+	handler DataChannelHandler
 }
 
 func NewTunnel(
 	webrtcConfig webrtc.Configuration,
-	transport http.RoundTripper,
+	handler DataChannelHandler,
 	clientID string,
+	jar http.CookieJar,
 	onICECandidate func(*webrtc.ICECandidate),
 ) (*Tunnel, error) {
 	pc, err := webrtc.NewPeerConnection(webrtcConfig)
@@ -28,24 +40,26 @@ func NewTunnel(
 		return nil, err
 	}
 
-	jar, err := cookiejar.New(nil)
-	if err != nil {
-		return nil, err
-	}
-	client := &http.Client{
-		Jar:           jar,
-		Transport:     transport,
-		CheckRedirect: checkRedirect,
-	}
+	ctx, cancel := context.WithCancelCause(context.Background())
 
 	t := &Tunnel{
 		log:    log.New(os.Stderr, fmt.Sprintf("[Tunnel %s] ", clientID[:6]), log.LstdFlags),
-		client: client,
-		pc:     pc,
+		ctx:    ctx,
+		cancel: cancel,
+		client: ClientInfo{
+			ID:  clientID,
+			Jar: jar,
+		},
+		pc:      pc,
+		handler: handler,
 	}
 
 	pc.OnConnectionStateChange(func(pcs webrtc.PeerConnectionState) {
 		t.log.Printf("Connection state change: %s", pcs)
+
+		if pcs == webrtc.PeerConnectionStateFailed || pcs == webrtc.PeerConnectionStateClosed {
+			t.cancel(fmt.Errorf("peer connection %s", pcs))
+		}
 	})
 	pc.OnICECandidate(onICECandidate)
 	pc.OnDataChannel(t.onDataChannel)
@@ -56,7 +70,7 @@ func NewTunnel(
 func (t *Tunnel) Close() error {
 	t.log.Println("Closing...")
 
-	t.client.CloseIdleConnections()
+	t.cancel(errTunnelClosed)
 	return t.pc.Close()
 }
 
@@ -90,22 +104,16 @@ func (t *Tunnel) AddICECandidate(candidate webrtc.ICECandidateInit) error {
 func (t *Tunnel) onDataChannel(dc *webrtc.DataChannel) {
 	t.log.Printf("Data Channel %s, %d", dc.Label(), *dc.ID())
 
-	if dc.Label() == "http" {
-		hdc := NewHTTPDataChannel(t.client, dc)
-		go hdc.Run()
-	}
+	t.handler.HandleDataChannel(t.ctx, dc, t.client)
 }
 
-func checkRedirect(req *http.Request, via []*http.Request) error {
-	firstReq := req
-	if len(via) > 0 {
-		firstReq = via[0]
+// newHTTPClient creates a client for a tunnel's HTTP requests. Redirects aren't followed by the client, but by fetch.
+func newHTTPClient(transport http.RoundTripper, jar http.CookieJar) *http.Client {
+	return &http.Client{
+		Jar:       jar,
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
 	}
-
-	redirect := firstReq.Header.Get("Web-P2p-Tunnel-Redirect")
-	if redirect != "follow" {
-		return http.ErrUseLastResponse
-	}
-
-	return nil
 }
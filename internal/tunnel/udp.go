@@ -0,0 +1,190 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	udpMaxDatagramSize = 64 * 1024
+	udpQueueLength     = 64
+)
+
+// UDPHandler handles udp data channels.
+type UDPHandler struct {
+	Allowlist   Allowlist
+	IdleTimeout time.Duration
+	FlowControl FlowControl
+}
+
+func (h *UDPHandler) HandleDataChannel(ctx context.Context, dc *webrtc.DataChannel, client ClientInfo) {
+	udc := NewUDPDataChannel(ctx, h.Allowlist, h.IdleTimeout, dc, h.FlowControl)
+	go udc.Run()
+}
+
+// UDPDataChannel forwards UDP datagrams. The target host:port is named by the label (udp:host:port). Each message is
+// one datagram, in both directions. Clients should open the data channel unordered and without retransmits.
+// Datagrams are dropped rather than queued without bound, and the flow is closed once it has been idle for the idle
+// timeout.
+type UDPDataChannel struct {
+	log *log.Logger
+
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+
+	allowlist   Allowlist
+	idleTimeout time.Duration
+	dc          *webrtc.DataChannel
+	flowControl FlowControl
+
+	datagrams    chan []byte
+	lastActivity atomic.Int64
+}
+
+func NewUDPDataChannel(
+	ctx context.Context,
+	allowlist Allowlist,
+	idleTimeout time.Duration,
+	dc *webrtc.DataChannel,
+	flowControl FlowControl,
+) *UDPDataChannel {
+	ctx, cancel := context.WithCancelCause(ctx)
+
+	u := &UDPDataChannel{
+		log:         log.New(os.Stderr, fmt.Sprintf("[UDP Data Channel %d] ", *dc.ID()), log.LstdFlags),
+		ctx:         ctx,
+		cancel:      cancel,
+		allowlist:   allowlist,
+		idleTimeout: idleTimeout,
+		dc:          dc,
+		flowControl: flowControl,
+		datagrams:   make(chan []byte, udpQueueLength),
+	}
+	u.touch()
+
+	dc.OnMessage(u.onMessage)
+	dc.OnClose(u.onClose)
+
+	return u
+}
+
+// Run dials the target and forwards datagrams in both directions until the flow is idle or the data channel closes.
+func (u *UDPDataChannel) Run() {
+	defer u.dc.Close()
+
+	if u.dc.Ordered() {
+		u.log.Println("Data channel is ordered. Datagrams may be delayed by retransmits.")
+	}
+
+	target, ok := strings.CutPrefix(u.dc.Label(), "udp:")
+	if !ok {
+		u.log.Println("Rejected data channel. No target.")
+		return
+	}
+
+	if !u.allowlist.Allows(target) {
+		u.log.Printf("Rejected %s. Not allowed.", target)
+		return
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(u.ctx, "udp", target)
+	if err != nil {
+		u.log.Printf("Failed to dial %s: %v", target, err)
+		return
+	}
+	defer conn.Close()
+
+	stop := context.AfterFunc(u.ctx, func() {
+		_ = conn.Close()
+	})
+	defer stop()
+
+	u.log.Printf("Forwarding to %s", target)
+
+	go func() {
+		for {
+			select {
+			case datagram := <-u.datagrams:
+				if _, err := conn.Write(datagram); err != nil && u.ctx.Err() == nil {
+					u.log.Printf("Failed to write to %s: %v", target, err)
+				}
+
+			case <-u.ctx.Done():
+				return
+
+			}
+		}
+	}()
+
+	buf := make([]byte, udpMaxDatagramSize)
+	for {
+		if err := conn.SetReadDeadline(u.idleDeadline()); err != nil {
+			break
+		}
+
+		n, err := conn.Read(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				if time.Now().Before(u.idleDeadline()) {
+					// Datagrams were sent to the target since the deadline was set.
+					continue
+				}
+
+				u.log.Printf("Closing idle flow to %s", target)
+				break
+			}
+
+			if u.ctx.Err() == nil {
+				u.log.Printf("Failed to read from %s: %v", target, err)
+			}
+			break
+		}
+
+		u.touch()
+
+		if u.dc.BufferedAmount() > u.flowControl.HighThreshold {
+			// Like a congested network, drop the datagram.
+			continue
+		}
+
+		if err := u.dc.Send(buf[:n]); err != nil {
+			u.log.Printf("Failed to send: %v", err)
+			break
+		}
+	}
+
+	u.log.Printf("Closed %s", target)
+}
+
+func (u *UDPDataChannel) onMessage(msg webrtc.DataChannelMessage) {
+	u.touch()
+
+	select {
+	case u.datagrams <- msg.Data:
+	default:
+		// The target isn't keeping up. Drop the datagram.
+	}
+}
+
+func (u *UDPDataChannel) onClose() {
+	u.cancel(errDataChannelClosed)
+}
+
+func (u *UDPDataChannel) touch() {
+	u.lastActivity.Store(time.Now().UnixNano())
+}
+
+func (u *UDPDataChannel) idleDeadline() time.Time {
+	return time.Unix(0, u.lastActivity.Load()).Add(u.idleTimeout)
+}
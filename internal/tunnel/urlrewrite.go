@@ -0,0 +1,433 @@
+package tunnel
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// URL rewriting modes.
+const (
+	// RewriteURLsRelative rewrites absolute URLs of the target to paths, like "/docs".
+	RewriteURLsRelative = "relative"
+	// RewriteURLsOrigin rewrites absolute URLs of the target to URLs of the tunnel's origin, like
+	// "https://tunnel.example/docs".
+	RewriteURLsOrigin = "origin"
+)
+
+// urlRewriteHeaders are the response headers whose URLs are rewritten.
+var urlRewriteHeaders = []string{"Location", "Content-Location", "Link", "Refresh"}
+
+// urlRewriteChars are the first bytes of the patterns of a urlRewriter.
+const urlRewriteChars = `hw/\`
+
+type tunnelOriginKey struct{}
+
+// withTunnelOrigin returns a copy of ctx carrying the scheme and host of the tunnel's origin, for rewriteURLs.
+func withTunnelOrigin(ctx context.Context, in *http.Request) context.Context {
+	scheme := in.URL.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+
+	return context.WithValue(ctx, tunnelOriginKey{}, &url.URL{Scheme: scheme, Host: in.Host})
+}
+
+// rewriteURLs rewrites the route target's absolute URLs in the headers and body of resp. Bodies are rewritten if
+// they're HTML, CSS, JavaScript, or JSON, encoded with gzip, br, or not at all. They're rewritten as they're read, so
+// streamed responses stay streamed.
+func rewriteURLs(route Route, resp *http.Response) {
+	origin, _ := resp.Request.Context().Value(tunnelOriginKey{}).(*url.URL)
+	if origin == nil {
+		return
+	}
+
+	rw := newURLRewriter(route, origin)
+
+	for _, name := range urlRewriteHeaders {
+		values := resp.Header[name]
+		for i, value := range values {
+			values[i] = rw.rewriteString(value)
+		}
+	}
+
+	// A HEAD response has no body, but its header must match the rewritten GET response's.
+	head := resp.Request.Method == http.MethodHead && resp.StatusCode >= 200 &&
+		resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotModified
+
+	// Rewriting changes the length, so ranges of the original body can't be served.
+	if !head && !bodyAllowed(resp.Request, resp) || resp.StatusCode == http.StatusPartialContent ||
+		!rewritableContentType(resp.Header.Get("Content-Type")) {
+		return
+	}
+
+	var newDecoder func(io.Reader) (io.Reader, error)
+	var newEncoder func(io.Writer) flushWriteCloser
+	switch strings.ToLower(resp.Header.Get("Content-Encoding")) {
+	case "", "identity":
+	case "gzip", "x-gzip":
+		newDecoder = func(r io.Reader) (io.Reader, error) {
+			return gzip.NewReader(r)
+		}
+		newEncoder = func(w io.Writer) flushWriteCloser {
+			return gzip.NewWriter(w)
+		}
+	case "br":
+		newDecoder = func(r io.Reader) (io.Reader, error) {
+			return brotli.NewReader(r), nil
+		}
+		newEncoder = func(w io.Writer) flushWriteCloser {
+			return brotli.NewWriter(w)
+		}
+	default:
+		return
+	}
+
+	if !head {
+		var body io.ReadCloser = resp.Body
+		if newDecoder != nil {
+			body = &lazyDecodingReader{ReadCloser: body, newDecoder: newDecoder}
+		}
+		body = &urlRewritingReader{ReadCloser: body, rw: rw}
+		if newEncoder != nil {
+			body = newEncodingReader(body, newEncoder)
+		}
+
+		resp.Body = body
+	}
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+
+	// The rewritten body isn't byte-for-byte the one the target's ETag validates, but it's equivalent, so the ETag is
+	// weakened rather than dropped, and conditional requests still work.
+	if etag := resp.Header.Get("Etag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("Etag", "W/"+etag)
+	}
+}
+
+func rewritableContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	switch mediaType {
+	case "text/html", "application/xhtml+xml", "text/css", "text/javascript", "application/javascript",
+		"application/x-javascript", "application/json":
+		return true
+	}
+
+	return strings.HasSuffix(mediaType, "+json")
+}
+
+// urlRewriter replaces a target's absolute URLs. A URL is matched by the target's origin and path, with any scheme
+// the target's connections could use (http and ws, or https and wss) or none ("//host"), and with slashes escaped as
+// in JSON ("http:\/\/host"). The origin and path must be followed by a character that doesn't continue the host or
+// the path segment, so that "http://localhost:3000" doesn't match "http://localhost:30001".
+type urlRewriter struct {
+	patterns []urlRewritePattern
+}
+
+type urlRewritePattern struct {
+	from []byte
+	to   []byte
+	// slash is "/", or "\/" if the pattern's slashes are escaped. It's appended to an empty replacement that isn't
+	// followed by one.
+	slash []byte
+}
+
+// newURLRewriter creates a rewriter of route's target URLs for the route's paths on the tunnel's origin.
+func newURLRewriter(route Route, origin *url.URL) *urlRewriter {
+	target, _ := route.upstream()
+
+	// Requests for the route's prefix are proxied to the target's path, followed by the rest of the path if the
+	// prefix is stripped, or the whole path otherwise.
+	targetPath := strings.TrimSuffix(target.Path, "/")
+	publicPath := ""
+	if route.StripPrefix && route.Prefix != "/" {
+		publicPath = route.Prefix
+	}
+
+	schemes := []string{"http", "ws"}
+	publicSchemes := []string{origin.Scheme, "ws"}
+	if target.Scheme == "https" {
+		schemes = []string{"https", "wss"}
+	}
+	if origin.Scheme == "https" {
+		publicSchemes[1] = "wss"
+	}
+
+	var rw urlRewriter
+	for _, host := range targetHosts(target) {
+		for _, escaped := range []bool{false, true} {
+			for i, scheme := range append(schemes, "") {
+				from := "//" + host + targetPath
+				to := publicPath
+				if route.RewriteURLs == RewriteURLsOrigin {
+					to = "//" + origin.Host + publicPath
+				}
+				if scheme != "" {
+					from = scheme + ":" + from
+					if route.RewriteURLs == RewriteURLsOrigin {
+						to = publicSchemes[i] + ":" + to
+					}
+				}
+
+				slash := "/"
+				if escaped {
+					from = strings.ReplaceAll(from, "/", `\/`)
+					to = strings.ReplaceAll(to, "/", `\/`)
+					slash = `\/`
+				}
+
+				rw.patterns = append(rw.patterns, urlRewritePattern{
+					from:  []byte(from),
+					to:    []byte(to),
+					slash: []byte(slash),
+				})
+			}
+		}
+	}
+
+	return &rw
+}
+
+// targetHosts returns the ways target's host may be written: with and without its scheme's default port.
+func targetHosts(target *url.URL) []string {
+	defaultPort := "80"
+	if target.Scheme == "https" {
+		defaultPort = "443"
+	}
+
+	switch target.Port() {
+	case "":
+		return []string{target.Host, net.JoinHostPort(target.Hostname(), defaultPort)}
+	case defaultPort:
+		host := target.Hostname()
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+
+		return []string{target.Host, host}
+	default:
+		return []string{target.Host}
+	}
+}
+
+func (rw *urlRewriter) rewriteString(s string) string {
+	if !strings.ContainsAny(s, urlRewriteChars) {
+		return s
+	}
+
+	out, _, _ := rw.rewrite(nil, []byte(s), 0, true)
+	return string(out)
+}
+
+// rewrite appends the rewritten in to out. prev is the byte preceding in, or 0. Unless final, a suffix of in that may
+// be the start of a URL is left unprocessed, and returned as rest.
+func (rw *urlRewriter) rewrite(out, in []byte, prev byte, final bool) (_, rest []byte, _ byte) {
+	start := 0
+	for i := 0; i < len(in); {
+		j := bytes.IndexAny(in[i:], urlRewriteChars)
+		if j == -1 {
+			break
+		}
+
+		i += j
+		if i > 0 {
+			prev = in[i-1]
+		}
+
+		p, n, partial := rw.match(in[i:], prev, final)
+		if partial {
+			out = append(out, in[start:i]...)
+			return out, in[i:], prev
+		}
+		if p == nil {
+			i++
+			continue
+		}
+
+		out = append(out, in[start:i]...)
+		out = append(out, p.to...)
+		if len(p.to) == 0 && !bytes.HasPrefix(in[i+n:], p.slash) {
+			out = append(out, p.slash...)
+		}
+
+		i += n
+		start = i
+	}
+
+	out = append(out, in[start:]...)
+	if len(in) > 0 {
+		prev = in[len(in)-1]
+	}
+
+	return out, nil, prev
+}
+
+// match returns the pattern matching the start of in, and its length. If in may be the start of a match but is too
+// short to tell, and not final, partial is set.
+func (rw *urlRewriter) match(in []byte, prev byte, final bool) (_ *urlRewritePattern, n int, partial bool) {
+	if isURLChar(prev) || prev == ':' {
+		return nil, 0, false
+	}
+
+	for i := range rw.patterns {
+		p := &rw.patterns[i]
+
+		if len(in) <= len(p.from) {
+			if !bytes.HasPrefix(p.from, in) {
+				continue
+			}
+			if !final {
+				return nil, 0, true
+			}
+			if len(in) == len(p.from) {
+				return p, len(p.from), false
+			}
+
+			continue
+		}
+
+		if bytes.HasPrefix(in, p.from) && !isURLChar(in[len(p.from)]) && in[len(p.from)] != ':' {
+			return p, len(p.from), false
+		}
+	}
+
+	return nil, 0, false
+}
+
+// isURLChar reports whether c may continue a URL's scheme, host, or path segment.
+func isURLChar(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("+-._~", c) >= 0
+}
+
+// urlRewritingReader rewrites URLs in the body it reads. A suffix of each read that may be the start of a URL is held
+// until the next read shows whether it is.
+type urlRewritingReader struct {
+	io.ReadCloser
+
+	rw   *urlRewriter
+	buf  []byte
+	in   []byte
+	out  []byte
+	prev byte
+	err  error
+}
+
+func (r *urlRewritingReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.err != nil {
+			if len(r.in) > 0 {
+				r.out, _, r.prev = r.rw.rewrite(r.out, r.in, r.prev, true)
+				r.in = nil
+				continue
+			}
+
+			return 0, r.err
+		}
+
+		if r.buf == nil {
+			r.buf = make([]byte, 32*1024)
+		}
+
+		n, err := r.ReadCloser.Read(r.buf)
+		r.err = err
+		if n > 0 {
+			var rest []byte
+			r.out, rest, r.prev = r.rw.rewrite(r.out[:0], append(r.in, r.buf[:n]...), r.prev, false)
+			r.in = append(r.in[:0:0], rest...)
+		}
+	}
+
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+
+	return n, nil
+}
+
+// lazyDecodingReader creates its decoder on the first read, so that creating it doesn't wait for the body.
+type lazyDecodingReader struct {
+	io.ReadCloser
+
+	newDecoder func(io.Reader) (io.Reader, error)
+	decoder    io.Reader
+}
+
+func (r *lazyDecodingReader) Read(p []byte) (int, error) {
+	if r.decoder == nil {
+		decoder, err := r.newDecoder(r.ReadCloser)
+		if err != nil {
+			return 0, err
+		}
+
+		r.decoder = decoder
+	}
+
+	return r.decoder.Read(p)
+}
+
+type flushWriteCloser interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// encodingReader encodes the body it reads. The encoder is flushed after each read of the body, so that streamed
+// chunks aren't held back by compression.
+type encodingReader struct {
+	io.ReadCloser
+
+	buf     []byte
+	encoded bytes.Buffer
+	encoder flushWriteCloser
+	done    bool
+}
+
+func newEncodingReader(body io.ReadCloser, newEncoder func(io.Writer) flushWriteCloser) *encodingReader {
+	r := &encodingReader{ReadCloser: body}
+	r.encoder = newEncoder(&r.encoded)
+
+	return r
+}
+
+func (r *encodingReader) Read(p []byte) (int, error) {
+	for r.encoded.Len() == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+
+		if r.buf == nil {
+			r.buf = make([]byte, 32*1024)
+		}
+
+		n, err := r.ReadCloser.Read(r.buf)
+		if n > 0 {
+			if _, err := r.encoder.Write(r.buf[:n]); err != nil {
+				return 0, err
+			}
+			if err := r.encoder.Flush(); err != nil {
+				return 0, err
+			}
+		}
+		if err == io.EOF {
+			if err := r.encoder.Close(); err != nil {
+				return 0, err
+			}
+
+			r.done = true
+		} else if err != nil {
+			return 0, err
+		}
+	}
+
+	return r.encoded.Read(p)
+}
@@ -0,0 +1,207 @@
+package tunnel
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+var testTunnelOrigin = &url.URL{Scheme: "https", Host: "tunnel.example"}
+
+func TestURLRewriterEscapedSlashes(t *testing.T) {
+	route := Route{
+		Prefix:      "/api",
+		Target:      &url.URL{Scheme: "http", Host: "localhost:3000", Path: "/v1"},
+		StripPrefix: true,
+		RewriteURLs: RewriteURLsRelative,
+	}
+	rw := newURLRewriter(route, testTunnelOrigin)
+
+	for in, want := range map[string]string{
+		`{"url":"http:\/\/localhost:3000\/v1\/users"}`: `{"url":"\/api\/users"}`,
+		`{"url":"\/\/localhost:3000\/v1?q=1"}`:         `{"url":"\/api?q=1"}`,
+		`{"url":"http:\/\/localhost:3000\/v1"}`:        `{"url":"\/api"}`,
+		`{"url":"ws:\/\/localhost:3000\/v1\/ws"}`:      `{"url":"\/api\/ws"}`,
+		// Other hosts and paths that only share a prefix aren't rewritten.
+		`{"url":"http:\/\/localhost:30001\/v1\/users"}`: `{"url":"http:\/\/localhost:30001\/v1\/users"}`,
+		`{"url":"http:\/\/localhost:3000\/v10"}`:        `{"url":"http:\/\/localhost:3000\/v10"}`,
+	} {
+		if got := rw.rewriteString(in); got != want {
+			t.Errorf("rewriteString(%s): got %s, want %s", in, got, want)
+		}
+	}
+}
+
+func TestURLRewritingReaderChunks(t *testing.T) {
+	route := Route{
+		Prefix:      "/",
+		Target:      &url.URL{Scheme: "http", Host: "localhost:3000"},
+		RewriteURLs: RewriteURLsOrigin,
+	}
+	rw := newURLRewriter(route, testTunnelOrigin)
+
+	in := `<a href="http://localhost:3000/a">a</a> "http:\/\/localhost:3000\/b" //localhost:3000/c`
+	want := `<a href="https://tunnel.example/a">a</a> "https:\/\/tunnel.example\/b" //tunnel.example/c`
+
+	// URLs split across reads are rewritten as if they weren't.
+	for size := 1; size <= len(in); size++ {
+		r := &urlRewritingReader{ReadCloser: io.NopCloser(&shortReader{s: in, n: size}), rw: rw}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("reads of %d bytes: %v", size, err)
+		}
+		if string(got) != want {
+			t.Errorf("reads of %d bytes: got %s", size, got)
+		}
+	}
+}
+
+func TestRewriteURLsEncodings(t *testing.T) {
+	route := Route{
+		Prefix:      "/",
+		Target:      &url.URL{Scheme: "http", Host: "localhost:3000"},
+		RewriteURLs: RewriteURLsRelative,
+	}
+	body := `<a href="http://localhost:3000/login">` + strings.Repeat("x", 64*1024) + `</a>`
+	want := `<a href="/login">` + strings.Repeat("x", 64*1024) + `</a>`
+
+	for _, tc := range []struct {
+		encoding string
+		encode   func(io.Writer) io.WriteCloser
+		decode   func(io.Reader) (io.Reader, error)
+	}{
+		{
+			encoding: "",
+		},
+		{
+			encoding: "gzip",
+			encode:   func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+			decode:   func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		},
+		{
+			encoding: "br",
+			encode:   func(w io.Writer) io.WriteCloser { return brotli.NewWriter(w) },
+			decode:   func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil },
+		},
+	} {
+		var encoded bytes.Buffer
+		if tc.encode != nil {
+			w := tc.encode(&encoded)
+			_, _ = io.WriteString(w, body)
+			_ = w.Close()
+		} else {
+			encoded.WriteString(body)
+		}
+
+		resp := testRewriteResponse(encoded.Bytes())
+		resp.Header.Set("Content-Encoding", tc.encoding)
+		rewriteURLs(route, resp)
+
+		if resp.ContentLength != -1 || resp.Header.Get("Content-Length") != "" {
+			t.Errorf("%q: Content-Length wasn't removed", tc.encoding)
+		}
+		if etag := resp.Header.Get("Etag"); etag != `W/"v1"` {
+			t.Errorf("%q: got ETag %s, want a weak ETag", tc.encoding, etag)
+		}
+
+		var r io.Reader = resp.Body
+		if tc.decode != nil {
+			var err error
+			if r, err = tc.decode(r); err != nil {
+				t.Fatalf("%q: %v", tc.encoding, err)
+			}
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("%q: %v", tc.encoding, err)
+		}
+		if string(got) != want {
+			t.Errorf("%q: got %.40s..., want %.40s...", tc.encoding, got, want)
+		}
+	}
+}
+
+func TestRewriteURLsUnsupportedEncoding(t *testing.T) {
+	route := Route{
+		Prefix:      "/",
+		Target:      &url.URL{Scheme: "http", Host: "localhost:3000"},
+		RewriteURLs: RewriteURLsRelative,
+	}
+	body := []byte(`<a href="http://localhost:3000/login">`)
+
+	resp := testRewriteResponse(body)
+	resp.Header.Set("Content-Encoding", "zstd")
+	rewriteURLs(route, resp)
+
+	got, _ := io.ReadAll(resp.Body)
+	if !bytes.Equal(got, body) || resp.Header.Get("Etag") != `"v1"` {
+		t.Errorf("body with an unsupported encoding was rewritten: %s, ETag %s", got, resp.Header.Get("Etag"))
+	}
+}
+
+func TestRewriteURLsHead(t *testing.T) {
+	route := Route{
+		Prefix:      "/",
+		Target:      &url.URL{Scheme: "http", Host: "localhost:3000"},
+		RewriteURLs: RewriteURLsRelative,
+	}
+
+	resp := testRewriteResponse(nil)
+	resp.Request.Method = http.MethodHead
+	resp.Header.Set("Content-Length", "38")
+	resp.ContentLength = 38
+	resp.Body = http.NoBody
+	rewriteURLs(route, resp)
+
+	// The header matches the rewritten GET response's.
+	if resp.ContentLength != -1 || resp.Header.Get("Content-Length") != "" {
+		t.Error("Content-Length wasn't removed")
+	}
+	if etag := resp.Header.Get("Etag"); etag != `W/"v1"` {
+		t.Errorf("got ETag %s, want a weak ETag", etag)
+	}
+}
+
+// testRewriteResponse returns an HTML response of body to a request through the tunnel.
+func testRewriteResponse(body []byte) *http.Response {
+	req := httptest.NewRequest(http.MethodGet, "https://tunnel.example/", nil)
+	req = req.WithContext(withTunnelOrigin(context.Background(), req))
+
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header: http.Header{
+			"Content-Type":   {"text/html; charset=utf-8"},
+			"Content-Length": {strconv.Itoa(len(body))},
+			"Etag":           {`"v1"`},
+		},
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// shortReader reads s at most n bytes at a time.
+type shortReader struct {
+	s string
+	n int
+}
+
+func (r *shortReader) Read(p []byte) (int, error) {
+	if r.s == "" {
+		return 0, io.EOF
+	}
+
+	n := copy(p, r.s[:min(r.n, len(r.s))])
+	r.s = r.s[n:]
+
+	return n, nil
+}
@@ -0,0 +1,485 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v4"
+)
+
+// WebSocket data channels relay a WebSocket connection to the target. Each message is one frame: a header byte
+// followed by a payload. The header byte is the FIN bit (0x80) or'd with an opcode:
+//
+//	0x0: continuation of a fragmented text or binary message
+//	0x1: text message
+//	0x2: binary message
+//	0x3: open (JSON payload, always FIN)
+//	0x8: close (big endian uint16 close code followed by the UTF-8 reason, always FIN)
+//
+// The client starts with an open frame (webSocketOpenRequest). The server dials the target and answers with an open
+// frame (webSocketOpenResponse) or, if the dial fails, a close frame with code 1006.
+const (
+	wsOpcodeContinuation = 0x0
+	wsOpcodeText         = 0x1
+	wsOpcodeBinary       = 0x2
+	wsOpcodeOpen         = 0x3
+	wsOpcodeClose        = 0x8
+
+	wsFinBit = 0x80
+
+	wsMaxPayloadSize = mtu - 1
+	wsCloseTimeout   = 5 * time.Second
+)
+
+type webSocketOpenRequest struct {
+	URL       string            `json:"url"`
+	Protocols []string          `json:"protocols"`
+	Headers   map[string]string `json:"headers"`
+}
+
+type webSocketOpenResponse struct {
+	Protocol   string `json:"protocol"`
+	Extensions string `json:"extensions"`
+}
+
+// webSocketProxy dials WebSocket connections to the target of the route matching the requested path. Request header
+// rules rewrite the handshake.
+type webSocketProxy struct {
+	routes *Routes
+	rules  HeaderRules
+
+	dialer *websocket.Dialer
+}
+
+func newWebSocketProxy(routes *Routes, rules HeaderRules) *webSocketProxy {
+	return &webSocketProxy{
+		routes: routes,
+		rules:  rules,
+		dialer: websocket.DefaultDialer,
+	}
+}
+
+// Dial dials the target for a WebSocket opened by the client. Cookies are taken from and stored to jar using the URL
+// requested by the client, as for tunneled HTTP requests.
+func (p *webSocketProxy) Dial(
+	ctx context.Context,
+	jar http.CookieJar,
+	openReq webSocketOpenRequest,
+) (*websocket.Conn, *http.Response, error) {
+	reqURL, err := url.Parse(openReq.URL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cookieURL := *reqURL
+	switch reqURL.Scheme {
+	case "ws", "http":
+		cookieURL.Scheme = "http"
+	case "wss", "https":
+		cookieURL.Scheme = "https"
+	default:
+		return nil, nil, fmt.Errorf("unsupported scheme %q", reqURL.Scheme)
+	}
+
+	vhost, ok := p.routes.VirtualHost(reqURL.Host)
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown host %s", reqURL.Host)
+	}
+
+	route, ok := p.routes.Match(vhost, reqURL.Path)
+	if !ok {
+		return nil, nil, fmt.Errorf("no route for %s%s", vhost, reqURL.Path)
+	}
+	if route.IsFile() {
+		return nil, nil, fmt.Errorf("route %s serves files", route)
+	}
+	target, socket := route.upstream()
+
+	dialURL := target.JoinPath(route.stripPrefix(reqURL.Path))
+	if target.RawQuery == "" || reqURL.RawQuery == "" {
+		dialURL.RawQuery = target.RawQuery + reqURL.RawQuery
+	} else {
+		dialURL.RawQuery = target.RawQuery + "&" + reqURL.RawQuery
+	}
+	if target.Scheme == "https" {
+		dialURL.Scheme = "wss"
+	} else {
+		dialURL.Scheme = "ws"
+	}
+
+	header := make(http.Header)
+	for k, v := range openReq.Headers {
+		k = http.CanonicalHeaderKey(k)
+		if k == "Upgrade" || k == "Connection" || strings.HasPrefix(k, "Sec-Websocket-") {
+			continue
+		}
+
+		header.Set(k, v)
+	}
+
+	if !route.ChangeHostHeader {
+		header.Set("Host", reqURL.Host)
+	} else {
+		header.Del("Host")
+	}
+
+	if route.ChangeOriginHeader {
+		header.Set("Origin", fmt.Sprintf("%s://%s", target.Scheme, target.Host))
+	}
+
+	header.Set("X-Forwarded-Host", reqURL.Host)
+	header.Set("X-Forwarded-Proto", cookieURL.Scheme)
+	if route.StripPrefix && route.Prefix != "/" {
+		header.Set("X-Forwarded-Prefix", route.Prefix)
+	}
+
+	if jar != nil && header.Get("Cookie") == "" {
+		for _, cookie := range jar.Cookies(&cookieURL) {
+			header.Add("Cookie", cookie.String())
+		}
+	}
+
+	p.rules.rewriteRequest(&http.Request{Method: http.MethodGet, URL: reqURL}, header)
+
+	dialer := *p.dialer
+	dialer.Subprotocols = openReq.Protocols
+	if route.tlsConfig != nil {
+		dialer.TLSClientConfig = route.tlsConfig
+	}
+	if socket != "" {
+		dialer.Proxy = nil
+		dialer.NetDialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		}
+	}
+
+	conn, resp, err := dialer.DialContext(ctx, dialURL.String(), header)
+	if resp != nil && jar != nil {
+		if cookies := resp.Cookies(); len(cookies) > 0 {
+			jar.SetCookies(&cookieURL, cookies)
+		}
+	}
+	if err != nil {
+		return nil, resp, err
+	}
+
+	return conn, resp, nil
+}
+
+type WebSocketDataChannel struct {
+	log *log.Logger
+
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+
+	proxy *webSocketProxy
+	jar   http.CookieJar
+	dc    *webrtc.DataChannel
+	fc    *flowController
+
+	mu     sync.Mutex
+	conn   *websocket.Conn
+	closed bool
+
+	// w is the writer for the message being relayed to the target. It's only used by onMessage.
+	w io.WriteCloser
+}
+
+func NewWebSocketDataChannel(
+	ctx context.Context,
+	proxy *webSocketProxy,
+	jar http.CookieJar,
+	dc *webrtc.DataChannel,
+	flowControl FlowControl,
+) *WebSocketDataChannel {
+	ctx, cancel := context.WithCancelCause(ctx)
+
+	wdc := &WebSocketDataChannel{
+		log:    log.New(os.Stderr, fmt.Sprintf("[WebSocket Data Channel %d] ", *dc.ID()), log.LstdFlags),
+		ctx:    ctx,
+		cancel: cancel,
+		proxy:  proxy,
+		jar:    jar,
+		dc:     dc,
+		fc:     newFlowController(dc, flowControl),
+	}
+
+	dc.OnMessage(wdc.onMessage)
+	dc.OnClose(wdc.onClose)
+
+	return wdc
+}
+
+func (w *WebSocketDataChannel) onMessage(msg webrtc.DataChannelMessage) {
+	if len(msg.Data) == 0 {
+		w.fail(errors.New("empty frame"))
+		return
+	}
+
+	fin := msg.Data[0]&wsFinBit != 0
+	opcode := msg.Data[0] &^ wsFinBit
+	payload := msg.Data[1:]
+
+	w.mu.Lock()
+	conn := w.conn
+	w.mu.Unlock()
+
+	if conn == nil {
+		if opcode != wsOpcodeOpen {
+			w.fail(errors.New("expected open frame"))
+			return
+		}
+
+		w.open(payload)
+		return
+	}
+
+	switch opcode {
+	case wsOpcodeText, wsOpcodeBinary:
+		if w.w != nil {
+			w.fail(errors.New("new message before previous message finished"))
+			return
+		}
+
+		messageType := websocket.TextMessage
+		if opcode == wsOpcodeBinary {
+			messageType = websocket.BinaryMessage
+		}
+
+		mw, err := conn.NextWriter(messageType)
+		if err != nil {
+			w.fail(err)
+			return
+		}
+		w.w = mw
+
+		w.writeFragment(payload, fin)
+
+	case wsOpcodeContinuation:
+		if w.w == nil {
+			w.fail(errors.New("continuation without a message"))
+			return
+		}
+
+		w.writeFragment(payload, fin)
+
+	case wsOpcodeClose:
+		code := websocket.CloseNoStatusReceived
+		reason := ""
+		if len(payload) >= 2 {
+			code = int(binary.BigEndian.Uint16(payload))
+			reason = string(payload[2:])
+		}
+
+		w.log.Printf("Client closed: %d %s", code, reason)
+
+		err := conn.WriteControl(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(code, reason),
+			time.Now().Add(time.Second),
+		)
+		if err != nil {
+			w.fail(err)
+			return
+		}
+
+		// The target's close frame is relayed by readPump. Don't wait for it forever.
+		time.AfterFunc(wsCloseTimeout, func() {
+			_ = conn.Close()
+		})
+
+	default:
+		w.fail(fmt.Errorf("unknown opcode %d", opcode))
+
+	}
+}
+
+func (w *WebSocketDataChannel) onClose() {
+	w.cancel(errDataChannelClosed)
+	w.fc.Close()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.closed = true
+	if w.conn != nil {
+		_ = w.conn.Close()
+	}
+}
+
+func (w *WebSocketDataChannel) open(payload []byte) {
+	var openReq webSocketOpenRequest
+	if err := json.Unmarshal(payload, &openReq); err != nil {
+		w.fail(err)
+		return
+	}
+
+	w.log.Printf("Opening %s", openReq.URL)
+
+	conn, resp, err := w.proxy.Dial(w.ctx, w.jar, openReq)
+	if err != nil {
+		if resp != nil {
+			err = fmt.Errorf("%w (%s)", err, resp.Status)
+		}
+
+		w.fail(err)
+		return
+	}
+
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+
+		_ = conn.Close()
+		return
+	}
+	w.conn = conn
+	w.mu.Unlock()
+
+	start := time.Now()
+	context.AfterFunc(w.ctx, func() {
+		w.log.Printf("Closed %s after %s: %v", openReq.URL, time.Since(start), context.Cause(w.ctx))
+
+		_ = conn.Close()
+	})
+
+	// Like the default close handler, but a close initiated by the client has already been sent.
+	conn.SetCloseHandler(func(code int, text string) error {
+		err := conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, ""), time.Now().Add(time.Second))
+		if err != nil && !errors.Is(err, websocket.ErrCloseSent) {
+			return err
+		}
+
+		return nil
+	})
+
+	openResp, err := json.Marshal(webSocketOpenResponse{
+		Protocol:   conn.Subprotocol(),
+		Extensions: resp.Header.Get("Sec-WebSocket-Extensions"),
+	})
+	if err != nil {
+		w.fail(err)
+		return
+	}
+
+	if err := w.sendFrame(wsFinBit|wsOpcodeOpen, openResp); err != nil {
+		w.fail(err)
+		return
+	}
+
+	w.log.Printf("Opened %s", openReq.URL)
+
+	go w.readPump(conn)
+}
+
+func (w *WebSocketDataChannel) writeFragment(payload []byte, fin bool) {
+	if _, err := w.w.Write(payload); err != nil {
+		w.fail(err)
+		return
+	}
+
+	if fin {
+		err := w.w.Close()
+		w.w = nil
+		if err != nil {
+			w.fail(err)
+			return
+		}
+	}
+}
+
+// readPump relays messages from the target to the client until the connection closes.
+func (w *WebSocketDataChannel) readPump(conn *websocket.Conn) {
+	buf := make([]byte, wsMaxPayloadSize)
+
+	for {
+		messageType, r, err := conn.NextReader()
+		if err != nil {
+			var closeErr *websocket.CloseError
+			if errors.As(err, &closeErr) {
+				w.log.Printf("Target closed: %d %s", closeErr.Code, closeErr.Text)
+
+				_ = w.sendClose(closeErr.Code, closeErr.Text)
+				_ = w.dc.Close()
+				return
+			}
+
+			w.fail(err)
+			return
+		}
+
+		opcode := byte(wsOpcodeText)
+		if messageType == websocket.BinaryMessage {
+			opcode = wsOpcodeBinary
+		}
+
+		for {
+			n, err := io.ReadFull(r, buf)
+			fin := err == io.EOF || err == io.ErrUnexpectedEOF
+			if err != nil && !fin {
+				w.fail(err)
+				return
+			}
+
+			header := opcode
+			if fin {
+				header |= wsFinBit
+			}
+
+			if err := w.sendFrame(header, buf[:n]); err != nil {
+				w.log.Printf("Failed to send message: %v", err)
+
+				_ = conn.Close()
+				return
+			}
+
+			if fin {
+				break
+			}
+			opcode = wsOpcodeContinuation
+		}
+	}
+}
+
+// fail closes the connection abnormally, telling the client why.
+func (w *WebSocketDataChannel) fail(err error) {
+	w.log.Printf("WebSocket failed: %v", err)
+
+	_ = w.sendClose(websocket.CloseAbnormalClosure, err.Error())
+	_ = w.dc.Close()
+}
+
+func (w *WebSocketDataChannel) sendClose(code int, reason string) error {
+	// Close reasons are limited to 123 bytes by the WebSocket protocol.
+	if len(reason) > 123 {
+		reason = strings.ToValidUTF8(reason[:123], "")
+	}
+
+	payload := make([]byte, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	copy(payload[2:], reason)
+
+	return w.sendFrame(wsFinBit|wsOpcodeClose, payload)
+}
+
+func (w *WebSocketDataChannel) sendFrame(header byte, payload []byte) error {
+	frame := make([]byte, 1+len(payload))
+	frame[0] = header
+	copy(frame[1:], payload)
+
+	return w.fc.Send(frame)
+}
@@ -0,0 +1,146 @@
+import { sasCommitment, sasNonce, shortAuthString } from './sas';
+
+const CONTROL_PROTOCOL_VERSION = 1;
+
+type ControlMessage = {
+  id?: number;
+  type: string;
+  data: any;
+};
+
+const CLIENT_KEY_STORAGE_KEY = 'web-p2p-tunnel-client-key';
+
+const encoder = new TextEncoder();
+
+// setupControl speaks the control protocol on dc, the control data channel of pc. If the tunnel
+// requires authentication, the client authenticates with secret, the tunnel's passphrase or token,
+// or with one the user is prompted for if secret is empty. Once it may, it derives the short
+// authentication string with the server and shows it in sasEl, to be compared with the one
+// web-p2p-tunnel logs, or typed into it with -verify-sas. onCapabilities is called with the data
+// channel labels the server lists in its hello.
+export function setupControl(
+  pc: RTCPeerConnection,
+  dc: RTCDataChannel,
+  secret: string,
+  statusEl: HTMLElement,
+  sasEl: HTMLElement,
+  onCapabilities: (capabilities: string[]) => void,
+) {
+  let nextID = 1;
+  const send = (type: string, data: unknown, id = nextID++) => {
+    dc.send(JSON.stringify({ id, type, data }));
+  };
+
+  // The nonce is committed to before the server sends its own, and only revealed after.
+  const clientNonce = sasNonce();
+  let sasStarted = false;
+  const startSAS = async () => {
+    if (!sasStarted) {
+      sasStarted = true;
+      send('sasCommit', { commitment: await sasCommitment(clientNonce) });
+    }
+  };
+
+  statusEl.innerText = dc.readyState;
+  dc.addEventListener('open', () => {
+    statusEl.innerText = dc.readyState;
+  });
+  dc.addEventListener('close', () => {
+    statusEl.innerText = dc.readyState;
+  });
+
+  dc.addEventListener('message', async (ev) => {
+    const message = JSON.parse(ev.data) as ControlMessage;
+    switch (message.type) {
+      case 'hello':
+        onCapabilities(message.data.capabilities ?? []);
+        send('hello', {
+          version: CONTROL_PROTOCOL_VERSION,
+          capabilities: ['http'],
+          clientKey: clientKey(),
+          userAgent: navigator.userAgent,
+        });
+
+        if (message.data.authChallenge) {
+          if (!secret) {
+            secret = prompt('The tunnel requires a passphrase or token:') ?? '';
+          }
+          if (!secret) {
+            statusEl.innerText = 'authentication required';
+            return;
+          }
+
+          statusEl.innerText = 'authenticating';
+          send('authenticate', { hmac: await hmac(secret, message.data.authChallenge) });
+        } else {
+          await startSAS();
+        }
+        break;
+
+      case 'authenticated':
+        statusEl.innerText = 'authenticated';
+        await startSAS();
+        break;
+
+      case 'sasNonce':
+        sasEl.innerText = (await shortAuthString(pc, clientNonce, message.data.nonce)) ?? 'unknown';
+        send('sasReveal', { nonce: clientNonce });
+        break;
+
+      case 'sasConfirmed':
+        statusEl.innerText = 'short authentication string confirmed';
+        break;
+
+      case 'approved':
+        statusEl.innerText = 'approved';
+        break;
+
+      case 'notice':
+        statusEl.innerText = message.data.message;
+        break;
+
+      case 'goingAway':
+        statusEl.innerText = `going away: ${message.data.reason}`;
+        break;
+
+      case 'error':
+        console.warn('Control error', message.data.message);
+        statusEl.innerText = `error: ${message.data.message}`;
+        break;
+
+      case 'ping':
+        send('pong', message.data, message.id);
+        break;
+    }
+  });
+}
+
+// clientKey returns the key the tunnel recognizes this browser by, to keep its cookies across
+// connections. It's generated the first time, and kept in localStorage.
+function clientKey(): string {
+  let key = localStorage.getItem(CLIENT_KEY_STORAGE_KEY);
+  if (key === null) {
+    key = base64(crypto.getRandomValues(new Uint8Array(32)));
+    localStorage.setItem(CLIENT_KEY_STORAGE_KEY, key);
+  }
+
+  return key;
+}
+
+// hmac returns the base64-encoded HMAC-SHA256 of message, keyed with secret.
+async function hmac(secret: string, message: string): Promise<string> {
+  const key = await crypto.subtle.importKey(
+    'raw',
+    encoder.encode(secret),
+    { name: 'HMAC', hash: 'SHA-256' },
+    false,
+    ['sign'],
+  );
+  const mac = new Uint8Array(await crypto.subtle.sign('HMAC', key, encoder.encode(message)));
+
+  return base64(mac);
+}
+
+function base64(b: Uint8Array): string {
+  return btoa(String.fromCharCode(...b));
+}
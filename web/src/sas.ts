@@ -0,0 +1,66 @@
+const encoder = new TextEncoder();
+
+// shortAuthString derives the tunnel's short authentication string from the DTLS fingerprints of
+// both peers and their nonces, like web-p2p-tunnel does. The client commits to its nonce with
+// sasCommitment before the server sends its own, so a server in the middle can't make the strings
+// on both sides match. It's the first four bytes of the SHA-256 of the server's fingerprint, the
+// client's, the client's nonce, and the server's, separated by newlines, as a big endian integer
+// modulo a million, formatted like "012 345". It's null until both descriptions are set.
+export async function shortAuthString(
+  pc: RTCPeerConnection,
+  clientNonce: string,
+  serverNonce: string,
+): Promise<string | null> {
+  const offer = pc.localDescription;
+  const answer = pc.remoteDescription;
+  if (offer === null || answer === null) {
+    return null;
+  }
+
+  const serverFingerprint = sdpFingerprint(answer.sdp);
+  const clientFingerprint = sdpFingerprint(offer.sdp);
+  if (serverFingerprint === null || clientFingerprint === null) {
+    return null;
+  }
+
+  const sum = await sha256(
+    `${serverFingerprint}\n${clientFingerprint}\n${clientNonce}\n${serverNonce}`,
+  );
+  const n = new DataView(sum).getUint32(0) % 1_000_000;
+
+  return `${pad(Math.floor(n / 1000))} ${pad(n % 1000)}`;
+}
+
+// sasNonce returns a random nonce for the short authentication string exchange.
+export function sasNonce(): string {
+  return base64(crypto.getRandomValues(new Uint8Array(32)));
+}
+
+// sasCommitment returns the commitment to nonce, its base64-encoded SHA-256.
+export async function sasCommitment(nonce: string): Promise<string> {
+  return base64(new Uint8Array(await sha256(nonce)));
+}
+
+// sdpFingerprint returns the SHA-256 DTLS fingerprint in sdp, in upper case, like "AB:CD:...".
+function sdpFingerprint(sdp: string): string | null {
+  for (const line of sdp.split('\n')) {
+    const match = /^a=fingerprint:(\S+) (.+)$/.exec(line.trim());
+    if (match !== null && match[1].toLowerCase() === 'sha-256') {
+      return match[2].trim().toUpperCase();
+    }
+  }
+
+  return null;
+}
+
+function pad(n: number): string {
+  return n.toString().padStart(3, '0');
+}
+
+function sha256(s: string): Promise<ArrayBuffer> {
+  return crypto.subtle.digest('SHA-256', encoder.encode(s));
+}
+
+function base64(b: Uint8Array): string {
+  return btoa(String.fromCharCode(...b));
+}
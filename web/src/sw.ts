@@ -7,8 +7,15 @@ export type RequestData = {
   serialized: ArrayBuffer;
 };
 
+// Tunnel tunnels a serialized request, whose body is streamed after its header, and returns the
+// serialized response, streamed as it's received.
+export type Tunnel = (
+  header: ArrayBuffer,
+  body: ReadableStream<Uint8Array> | null,
+) => ReadableStream<Uint8Array>;
+
 export async function setupSW(
-  tunnel: (serialized: ArrayBuffer) => Promise<ArrayBuffer>,
+  tunnel: Tunnel,
   statusEl: HTMLElement,
   requestsEl: HTMLElement,
 ) {
@@ -35,34 +42,70 @@ export async function setupSW(
     });
   }
 
-  navigator.serviceWorker.addEventListener('message', async (ev) => {
-    if (ev.data.type === 'request') {
+  // Request bodies are posted by the service worker as they're read.
+  const bodies = new Map<number, ReadableStreamDefaultController<Uint8Array>>();
+  // Responses are read until they end, or the service worker cancels them.
+  const responses = new Map<number, ReadableStreamDefaultReader<Uint8Array>>();
+
+  navigator.serviceWorker.addEventListener('message', (ev) => {
+    if (ev.data.type === 'responseCancel') {
+      responses.get(ev.data.id)?.cancel();
+      responses.delete(ev.data.id);
+    } else if (ev.data.type === 'requestBody') {
+      bodies.get(ev.data.id)?.enqueue(ev.data.chunk);
+    } else if (ev.data.type === 'requestBodyEnd') {
+      bodies.get(ev.data.id)?.close();
+      bodies.delete(ev.data.id);
+    } else if (ev.data.type === 'requestBodyError') {
+      bodies.get(ev.data.id)?.error(new Error('failed to read request body'));
+      bodies.delete(ev.data.id);
+    } else if (ev.data.type === 'request') {
       const data = ev.data as RequestData;
       addToTable(data, requestsEl);
 
-      let resp;
-      try {
-        resp = await tunnel(data.serialized);
-      } catch (ex) {
-        if (ex instanceof ArrayBuffer) {
-          resp = ex;
-        } else {
-          throw ex;
-        }
+      let body: ReadableStream<Uint8Array> | null = null;
+      if (data.hasBody) {
+        body = new ReadableStream({
+          start(controller) {
+            bodies.set(data.id, controller);
+          },
+        });
       }
 
-      ev.source?.postMessage(
-        {
-          type: 'response',
-          id: data.id,
-          serialized: resp,
-        },
-        { transfer: [resp] },
-      );
+      if (ev.source !== null) {
+        const reader = tunnel(data.serialized, body).getReader();
+        responses.set(data.id, reader);
+        streamResponse(ev.source, data.id, reader).finally(() => responses.delete(data.id));
+      }
     }
   });
 }
 
+// streamResponse posts the serialized response to request id to the service worker as it's read
+// from reader, so that the page gets it without it being buffered.
+async function streamResponse(
+  sw: MessageEventSource,
+  id: number,
+  reader: ReadableStreamDefaultReader<Uint8Array>,
+) {
+  try {
+    for (;;) {
+      const { done, value } = await reader.read();
+      if (done) {
+        break;
+      }
+
+      sw.postMessage({ type: 'response', id, chunk: value }, { transfer: [value.buffer] });
+    }
+  } catch (error) {
+    console.warn(`Failed to tunnel response to request ${id}`, error);
+    sw.postMessage({ type: 'responseError', id });
+    return;
+  }
+
+  sw.postMessage({ type: 'responseEnd', id });
+}
+
 function addToTable(
   { id, method, url, headersList, hasBody }: RequestData,
   requestsEl: HTMLElement,
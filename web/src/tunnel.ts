@@ -1,8 +1,13 @@
+import { setupControl } from './control';
 import { connectSignalingClient } from './signalingClient';
 import { setupSW } from './sw';
 import { connectWebRTC } from './webrtc';
 
 const MTU = 16 * 1024 - 1;
+// Sending pauses while more than BUFFERED_AMOUNT_HIGH_THRESHOLD bytes are buffered, until the
+// buffered amount falls to BUFFERED_AMOUNT_LOW_THRESHOLD.
+const BUFFERED_AMOUNT_HIGH_THRESHOLD = 1024 * 1024;
+const BUFFERED_AMOUNT_LOW_THRESHOLD = 256 * 1024;
 const TUNNEL_UNAVAILABLE_RESPONSE =
   'HTTP/1.1 503 Service Unavailable\r\n' +
   'Content-Type: text/html\r\n' +
@@ -10,83 +15,371 @@ const TUNNEL_UNAVAILABLE_RESPONSE =
   '<h1>503: Service Unavailable</h1>' +
   '<p>The tunnel is disconnected. <a href="/tunnel">Tunnel page</a>.</p>';
 const TUNNEL_ERROR_RESPONSE = 'HTTP/1.1 502 Bad Gateway\r\n\r\n';
+// Each frame of the http-mux data channel has a 4 byte stream ID, a 1 byte type, and a 4 byte
+// payload length, all big endian, followed by the payload.
+const MUX_FRAME_HEADER_SIZE = 9;
+const MUX_MAX_PAYLOAD_SIZE = MTU - MUX_FRAME_HEADER_SIZE;
+const MUX_FRAME_HEADERS = 1;
+const MUX_FRAME_DATA = 2;
+const MUX_FRAME_END = 3;
+const MUX_FRAME_RESET = 4;
 
 const encoder = new TextEncoder();
 
+type Mux = {
+  dc: RTCDataChannel;
+  // streams are the writers of the responses of open streams, by stream ID.
+  streams: Map<number, ResponseWriter>;
+  nextStreamID: number;
+};
+
+// ResponseWriter writes a serialized response as it's received. If it fails before any of it was,
+// the response is a 502, since the request may not have reached the target. If it fails after, the
+// response errors.
+type ResponseWriter = {
+  write(data: Uint8Array): void;
+  end(): void;
+  fail(reason: string): void;
+};
+
 const tunnelConnectFormEl = document.getElementById('tunnel-connect') as HTMLFormElement;
 const swStatusEl = document.getElementById('sw-status')!;
 const signalingStatusEl = document.getElementById('signaling-status')!;
 const webRTCStatusEl = document.getElementById('webrtc-status')!;
+const controlStatusEl = document.getElementById('control-status')!;
+const sasEl = document.getElementById('sas')!;
 const requestsEl = document.getElementById('requests')!;
 
 let pc: RTCPeerConnection | null = null;
+// mux is the http-mux data channel requests are tunneled over while it's open, or null if it isn't
+// open or opening. muxSupported is whether web-p2p-tunnel listed http-mux in its hello.
+let mux: Mux | null = null;
+let muxSupported = false;
 
 await setupSW(tunnel, swStatusEl, requestsEl);
 
-async function tunnel(serialized: ArrayBuffer): Promise<ArrayBuffer> {
-  return new Promise((resolve, reject) => {
-    if (pc === null) {
-      reject(encoder.encode(TUNNEL_UNAVAILABLE_RESPONSE).buffer);
+// tunnel tunnels a request, and returns the serialized response as it's received. Requests are
+// tunneled as streams of the http-mux data channel while it's open, and over an http data channel
+// each otherwise.
+function tunnel(
+  header: ArrayBuffer,
+  body: ReadableStream<Uint8Array> | null,
+): ReadableStream<Uint8Array> {
+  if (pc === null) {
+    return new ReadableStream({
+      start(controller) {
+        controller.enqueue(encoder.encode(TUNNEL_UNAVAILABLE_RESPONSE));
+        controller.close();
+      },
+    });
+  }
+
+  if (mux === null && muxSupported) {
+    // The http-mux data channel is opened, again if it closed, for the requests that follow.
+    mux = openMux(pc);
+  }
+  if (mux !== null && mux.dc.readyState === 'open') {
+    return tunnelMux(mux, header, body);
+  }
+
+  return tunnelDataChannel(pc, header, body);
+}
+
+// tunnelDataChannel tunnels a request over a new http data channel of connection. An empty message
+// marks the end of the request and of the response.
+function tunnelDataChannel(
+  connection: RTCPeerConnection,
+  header: ArrayBuffer,
+  body: ReadableStream<Uint8Array> | null,
+): ReadableStream<Uint8Array> {
+  const dc = connection.createDataChannel('http');
+  dc.binaryType = 'arraybuffer';
+  dc.bufferedAmountLowThreshold = BUFFERED_AMOUNT_LOW_THRESHOLD;
+
+  // Closing the data channel cancels the request to the target.
+  const [response, writer] = responseStream(() => dc.close());
+
+  dc.addEventListener('open', async () => {
+    if (await sendRequest(dc, header, body, (data) => send(dc, data))) {
+      dc.send(new ArrayBuffer(0));
+    } else {
+      dc.close();
+    }
+  });
+
+  dc.addEventListener('close', () => {
+    writer.fail('data channel closed');
+  });
+
+  dc.addEventListener('message', (ev) => {
+    if (!(ev.data instanceof ArrayBuffer)) {
+      writer.fail('unexpected text message');
+      dc.close();
       return;
     }
 
-    const dc = pc.createDataChannel('http');
-    dc.binaryType = 'arraybuffer';
+    if (ev.data.byteLength === 0) {
+      writer.end();
+      dc.close();
+      return;
+    }
 
-    dc.addEventListener('open', () => {
-      const arr = new Uint8Array(serialized);
-      const count = Math.ceil(arr.length / MTU);
-      for (let i = 0; i < count; i++) {
-        const fragment = arr.subarray(i * MTU, Math.min((i + 1) * MTU, arr.length));
-        dc.send(fragment);
-      }
+    writer.write(new Uint8Array(ev.data));
+  });
 
-      dc.send(new ArrayBuffer(0));
-    });
+  return response;
+}
 
-    dc.addEventListener('close', () => {
-      reject(encoder.encode(TUNNEL_ERROR_RESPONSE).buffer);
-    });
+// openMux opens the http-mux data channel of connection. If it closes, like when web-p2p-tunnel
+// doesn't multiplex requests or the client may not use the tunnel yet, its streams fail, and
+// requests fall back to an http data channel each.
+function openMux(connection: RTCPeerConnection): Mux {
+  const dc = connection.createDataChannel('http-mux');
+  dc.binaryType = 'arraybuffer';
+  dc.bufferedAmountLowThreshold = BUFFERED_AMOUNT_LOW_THRESHOLD;
+
+  const m: Mux = { dc, streams: new Map(), nextStreamID: 1 };
+
+  dc.addEventListener('close', () => {
+    if (mux === m) {
+      mux = null;
+    }
+
+    m.streams.forEach((writer) => writer.fail('http-mux data channel closed'));
+    m.streams.clear();
+  });
+
+  dc.addEventListener('message', (ev) => {
+    if (!(ev.data instanceof ArrayBuffer) || ev.data.byteLength < MUX_FRAME_HEADER_SIZE) {
+      dc.close();
+      return;
+    }
+
+    const view = new DataView(ev.data);
+    const streamID = view.getUint32(0);
+    const frameType = view.getUint8(4);
+    if (view.getUint32(5) !== ev.data.byteLength - MUX_FRAME_HEADER_SIZE) {
+      dc.close();
+      return;
+    }
+
+    // Frames of finished streams, like after a reset, are ignored.
+    const writer = m.streams.get(streamID);
+    if (writer === undefined) {
+      return;
+    }
+
+    switch (frameType) {
+      case MUX_FRAME_HEADERS:
+      case MUX_FRAME_DATA:
+        writer.write(new Uint8Array(ev.data, MUX_FRAME_HEADER_SIZE));
+        break;
+
+      case MUX_FRAME_END:
+        writer.end();
+        m.streams.delete(streamID);
+        break;
+
+      default:
+        writer.fail('stream reset');
+        m.streams.delete(streamID);
+        if (frameType !== MUX_FRAME_RESET) {
+          sendMuxFrame(m, streamID, MUX_FRAME_RESET);
+        }
+    }
+  });
 
-    const fragments: ArrayBuffer[] = [];
+  return m;
+}
+
+// tunnelMux tunnels a request as a new stream of m. Headers and data frames carry the request and
+// the response, and an end frame marks the end of each.
+function tunnelMux(
+  m: Mux,
+  header: ArrayBuffer,
+  body: ReadableStream<Uint8Array> | null,
+): ReadableStream<Uint8Array> {
+  const streamID = m.nextStreamID++;
+
+  // Resetting the stream cancels the request to the target.
+  const [response, writer] = responseStream(() => {
+    if (m.streams.delete(streamID)) {
+      sendMuxFrame(m, streamID, MUX_FRAME_RESET);
+    }
+  });
+  m.streams.set(streamID, writer);
+
+  let frameType = MUX_FRAME_HEADERS;
+  const sendData = (data: Uint8Array) => {
+    for (let i = 0; i < data.byteLength; i += MUX_MAX_PAYLOAD_SIZE) {
+      sendMuxFrame(m, streamID, frameType, data.subarray(i, i + MUX_MAX_PAYLOAD_SIZE));
+      frameType = MUX_FRAME_DATA;
+    }
+  };
+
+  sendRequest(m.dc, header, body, sendData).then((sent) => {
+    if (!m.streams.has(streamID)) {
+      return;
+    }
 
-    const respond = () => {
-      const byteLength = fragments.reduce((prev, curr) => prev + curr.byteLength, 0);
-      const out = new ArrayBuffer(byteLength);
-      const arr = new Uint8Array(out);
+    if (sent) {
+      sendMuxFrame(m, streamID, MUX_FRAME_END);
+    } else {
+      // The body couldn't be read, so the request is aborted.
+      sendMuxFrame(m, streamID, MUX_FRAME_RESET);
+      writer.fail('request aborted');
+      m.streams.delete(streamID);
+    }
+  });
 
-      let i = 0;
-      for (const fragment of fragments) {
-        arr.set(new Uint8Array(fragment), i);
-        i += fragment.byteLength;
+  return response;
+}
+
+// sendMuxFrame sends a frame of the stream streamID over m, if it's open.
+function sendMuxFrame(
+  m: Mux,
+  streamID: number,
+  frameType: number,
+  payload: Uint8Array = new Uint8Array(0),
+) {
+  if (m.dc.readyState !== 'open') {
+    return;
+  }
+
+  const frame = new Uint8Array(MUX_FRAME_HEADER_SIZE + payload.byteLength);
+  const view = new DataView(frame.buffer);
+  view.setUint32(0, streamID);
+  view.setUint8(4, frameType);
+  view.setUint32(5, payload.byteLength);
+  frame.set(payload, MUX_FRAME_HEADER_SIZE);
+  m.dc.send(frame);
+}
+
+// sendRequest sends a request's header and then its body with sendData, pausing while dc's buffer
+// is full. It resolves to false if the body couldn't be read or dc closed, so the request is
+// aborted.
+async function sendRequest(
+  dc: RTCDataChannel,
+  header: ArrayBuffer,
+  body: ReadableStream<Uint8Array> | null,
+  sendData: (data: Uint8Array) => void,
+): Promise<boolean> {
+  if (dc.readyState !== 'open') {
+    return false;
+  }
+  sendData(new Uint8Array(header));
+  if (body === null) {
+    return true;
+  }
+
+  const reader = body.getReader();
+  try {
+    for (;;) {
+      const { done, value } = await reader.read();
+      if (done) {
+        return true;
       }
 
-      resolve(out);
-    };
+      await bufferedAmountLow(dc);
+      if (dc.readyState !== 'open') {
+        await reader.cancel();
+        return false;
+      }
+      sendData(value);
+    }
+  } catch {
+    return false;
+  }
+}
+
+// responseStream returns a stream of a serialized response, and a writer that writes it as it's
+// received. onCancel is called if the reader cancels the stream.
+function responseStream(onCancel: () => void): [ReadableStream<Uint8Array>, ResponseWriter] {
+  let controller!: ReadableStreamDefaultController<Uint8Array>;
+  let received = false;
+  let ended = false;
 
-    dc.addEventListener('message', (ev) => {
-      if (!(ev.data instanceof ArrayBuffer)) {
-        reject(encoder.encode(TUNNEL_ERROR_RESPONSE).buffer);
+  const stream = new ReadableStream<Uint8Array>({
+    start(c) {
+      controller = c;
+    },
+    cancel() {
+      ended = true;
+      onCancel();
+    },
+  });
+
+  const writer: ResponseWriter = {
+    write(data) {
+      if (!ended) {
+        received = true;
+        controller.enqueue(data);
+      }
+    },
+    end() {
+      if (!ended) {
+        ended = true;
+        controller.close();
+      }
+    },
+    fail(reason) {
+      if (ended) {
         return;
       }
+      ended = true;
 
-      if (ev.data.byteLength === 0) {
-        respond();
-        dc.close();
-        return;
+      if (received) {
+        controller.error(new Error(reason));
+      } else {
+        controller.enqueue(encoder.encode(TUNNEL_ERROR_RESPONSE));
+        controller.close();
       }
+    },
+  };
 
-      fragments.push(ev.data);
-    });
+  return [stream, writer];
+}
+
+// send sends data over dc in fragments of at most MTU bytes.
+function send(dc: RTCDataChannel, data: Uint8Array) {
+  const count = Math.ceil(data.length / MTU);
+  for (let i = 0; i < count; i++) {
+    dc.send(data.subarray(i * MTU, Math.min((i + 1) * MTU, data.length)));
+  }
+}
+
+// bufferedAmountLow resolves once dc's buffered amount is low enough to send more, or dc closes.
+function bufferedAmountLow(dc: RTCDataChannel): Promise<void> {
+  if (dc.bufferedAmount <= BUFFERED_AMOUNT_HIGH_THRESHOLD || dc.readyState !== 'open') {
+    return Promise.resolve();
+  }
+
+  return new Promise((resolve) => {
+    const done = () => {
+      dc.removeEventListener('bufferedamountlow', done);
+      dc.removeEventListener('close', done);
+      resolve();
+    };
+    dc.addEventListener('bufferedamountlow', done);
+    dc.addEventListener('close', done);
   });
 }
 
+// A link to the tunnel page may carry the room id and the tunnel's token in its fragment, like
+// "/tunnel#room=...&token=...". The fragment isn't sent to servers.
+const fragment = new URLSearchParams(location.hash.slice(1));
+(tunnelConnectFormEl.elements.namedItem('room-id') as HTMLInputElement).value =
+  fragment.get('room') ?? '';
+(tunnelConnectFormEl.elements.namedItem('secret') as HTMLInputElement).value =
+  fragment.get('token') ?? '';
+
 tunnelConnectFormEl.addEventListener('submit', (ev) => {
   ev.preventDefault();
 
   const data = new FormData(tunnelConnectFormEl);
   const roomID = data.get('room-id');
-  if (!(typeof roomID === 'string' && roomID)) {
+  const secret = data.get('secret') ?? '';
+  if (!(typeof roomID === 'string' && roomID && typeof secret === 'string')) {
     alert('Invalid data');
     return;
   }
@@ -98,6 +391,15 @@ tunnelConnectFormEl.addEventListener('submit', (ev) => {
   );
 
   sc.addEventListener('open', async () => {
-    pc = await connectWebRTC(sc, webRTCStatusEl);
+    mux = null;
+    muxSupported = false;
+
+    pc = await connectWebRTC(sc, webRTCStatusEl, (connection, dc) => {
+      setupControl(connection, dc, secret, controlStatusEl, sasEl, (capabilities) => {
+        if (pc === connection) {
+          muxSupported = capabilities.includes('http-mux');
+        }
+      });
+    });
   });
 });
@@ -1,4 +1,10 @@
-export async function connectWebRTC(sc: WebSocket, statusEl: HTMLElement) {
+// connectWebRTC connects to the tunnel through the signaling client sc. setupControl is called with
+// the peer connection and its control data channel before the offer is sent.
+export async function connectWebRTC(
+  sc: WebSocket,
+  statusEl: HTMLElement,
+  setupControl: (pc: RTCPeerConnection, dc: RTCDataChannel) => void,
+) {
   const pc = new RTCPeerConnection({
     iceServers: [{ urls: 'stun:stun.l.google.com:19302' }],
   });
@@ -34,7 +40,7 @@ export async function connectWebRTC(sc: WebSocket, statusEl: HTMLElement) {
     );
   });
 
-  pc.createDataChannel('control');
+  setupControl(pc, pc.createDataChannel('control'));
 
   const offer = await pc.createOffer();
   sc.send(
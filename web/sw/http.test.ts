@@ -0,0 +1,63 @@
+import assert from 'node:assert/strict';
+import { test } from 'node:test';
+import { deserializeResponse } from './http.ts';
+
+const encoder = new TextEncoder();
+const decoder = new TextDecoder();
+
+// serializedStream returns a stream of serialized response bytes, and a function that writes to it,
+// like the tunnel client does as a response's messages are received.
+function serializedStream(): [ReadableStream<Uint8Array>, (s: string | null) => void] {
+  let controller!: ReadableStreamDefaultController<Uint8Array>;
+  const stream = new ReadableStream<Uint8Array>({
+    start(c) {
+      controller = c;
+    },
+  });
+
+  return [stream, (s) => (s === null ? controller.close() : controller.enqueue(encoder.encode(s)))];
+}
+
+test('a flushed response reaches the page as it arrives', async () => {
+  const [serialized, write] = serializedStream();
+  write('HTTP/1.1 200 OK\r\nContent-Type: text/event-stream\r\nTransfer-Encoding: chunked\r\n\r\n');
+
+  // The response is passed on before it ends.
+  const res = await deserializeResponse(serialized);
+  assert.equal(res.status, 200);
+  assert.equal(res.headers.get('Content-Type'), 'text/event-stream');
+  assert.equal(res.headers.has('Transfer-Encoding'), false);
+
+  const reader = res.body!.getReader();
+  write('d\r\ndata: first\n\n\r\n');
+  assert.equal(decoder.decode((await reader.read()).value), 'data: first\n\n');
+
+  // Chunks may be split across messages.
+  write('e\r\ndata: sec');
+  assert.equal(decoder.decode((await reader.read()).value), 'data: sec');
+  write('ond\n\n\r\n0\r\n\r\n');
+  assert.equal(decoder.decode((await reader.read()).value), 'ond\n\n');
+
+  write(null);
+  assert.equal((await reader.read()).done, true);
+});
+
+test('declared trailers are added to the headers', async () => {
+  const [serialized, write] = serializedStream();
+  write('HTTP/1.1 200 OK\r\nTrailer: Grpc-Status\r\nTransfer-Encoding: chunked\r\n\r\n');
+  write('5\r\nhello\r\n0\r\nGrpc-Status: 0\r\n\r\n');
+  write(null);
+
+  const res = await deserializeResponse(serialized);
+  assert.equal(res.headers.get('Grpc-Status'), '0');
+  assert.equal(await res.text(), 'hello');
+});
+
+test('an incomplete chunked body errors', async () => {
+  const [serialized, write] = serializedStream();
+  write('HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhel');
+  write(null);
+
+  const res = await deserializeResponse(serialized);
+  await assert.rejects(res.text());
+});
@@ -1,6 +1,9 @@
 const CRLF = '\r\n';
 const CRLF_ENCODED = CRLF.split('').map((s) => s.charCodeAt(0));
 
+// NULL_BODY_STATUSES are the statuses of responses that can't have a body.
+const NULL_BODY_STATUSES = [204, 205, 304];
+
 const encoder = new TextEncoder();
 const decoder = new TextDecoder();
 
@@ -9,14 +12,41 @@ type UserAgentInfo = {
   userAgent: string;
 };
 
+export type SerializedRequest = {
+  header: ArrayBuffer;
+  // body is the serialized body, to be sent after the header, or null if the request has none.
+  body: ReadableStream<Uint8Array> | null;
+};
+
+// serializeRequest serializes the request's header. Its body is streamed with chunked transfer
+// coding, so it's sent as it's read. Browsers that don't expose request body streams get it
+// buffered and sent with a Content-Length.
 export async function serializeRequest(
   req: Request,
   { origin, userAgent }: UserAgentInfo,
-): Promise<ArrayBuffer> {
+): Promise<SerializedRequest> {
   const url = new URL(req.url);
   url.hash = '';
 
-  const body = await req.arrayBuffer();
+  let framing: [string, unknown];
+  let body: ReadableStream<Uint8Array> | null = null;
+  if (req.body === undefined) {
+    const buffered = new Uint8Array(await req.arrayBuffer());
+    framing = ['Content-Length', buffered.byteLength];
+    if (buffered.byteLength > 0) {
+      body = new ReadableStream({
+        start(controller) {
+          controller.enqueue(buffered);
+          controller.close();
+        },
+      });
+    }
+  } else if (req.body === null) {
+    framing = ['Content-Length', 0];
+  } else {
+    framing = ['Transfer-Encoding', 'chunked'];
+    body = req.body.pipeThrough(chunkedEncoder());
+  }
 
   const requestLine = `${req.method} ${url.toString()} HTTP/1.1`;
   const headerFields: string[] = [];
@@ -29,7 +59,7 @@ export async function serializeRequest(
     // TODO: set Origin to null in some cases (https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/Origin)
     ['Origin', origin],
     ['User-Agent', userAgent],
-    ['Content-Length', body.byteLength],
+    framing,
     ['Sec-Fetch-Dest', req.destination],
     ['Sec-Fetch-Mode', req.mode],
     ['Web-P2p-Tunnel-Redirect', req.redirect],
@@ -46,33 +76,204 @@ export async function serializeRequest(
   const headerStr = requestLine + CRLF + headerFields.join(CRLF) + CRLF + CRLF;
   const header = encoder.encode(headerStr);
 
-  const out = new Uint8Array(header.byteLength + body.byteLength);
-  out.set(header, 0);
-  out.set(new Uint8Array(body), header.byteLength);
+  return { header: header.buffer, body };
+}
 
-  return out.buffer;
+// chunkedEncoder encodes a body with chunked transfer coding. Each chunk is encoded into a new
+// buffer, so it can be transferred.
+function chunkedEncoder() {
+  return new TransformStream<Uint8Array, Uint8Array>({
+    transform(chunk, controller) {
+      if (chunk.byteLength === 0) {
+        return;
+      }
+
+      const size = encoder.encode(chunk.byteLength.toString(16) + CRLF);
+      const out = new Uint8Array(size.byteLength + chunk.byteLength + 2);
+      out.set(size, 0);
+      out.set(chunk, size.byteLength);
+      out.set(CRLF_ENCODED, size.byteLength + chunk.byteLength);
+      controller.enqueue(out);
+    },
+    flush(controller) {
+      controller.enqueue(encoder.encode('0' + CRLF + CRLF));
+    },
+  });
 }
 
-export function deserializeResponse(serialized: ArrayBuffer): Response {
-  const arr = new Uint8Array(serialized);
-  const headerEndIndex = findHeaderEndIndex(arr);
-  if (headerEndIndex === -1) {
+// deserializeResponse deserializes a response as it's received. It resolves once the header is,
+// with a body streamed from the rest of serialized. Responses that declare trailers with a Trailer
+// header are buffered, so that the trailers can be added to their headers, since responses given
+// to the page don't have trailers. Other trailers are dropped.
+export async function deserializeResponse(
+  serialized: ReadableStream<Uint8Array>,
+): Promise<Response> {
+  const reader = serialized.getReader();
+  let buffered = new Uint8Array(0);
+  let headerEndIndex = -1;
+  try {
+    while (headerEndIndex === -1) {
+      const { done, value } = await reader.read();
+      if (done) {
+        return Response.error();
+      }
+
+      buffered = concat(buffered, value);
+      headerEndIndex = findHeaderEndIndex(buffered);
+    }
+  } catch {
     return Response.error();
   }
 
-  const header = arr.subarray(0, headerEndIndex);
-  const body = arr.subarray(headerEndIndex + 4);
+  const header = buffered.subarray(0, headerEndIndex);
+  const rest = buffered.subarray(headerEndIndex + 4);
 
   const headerStr = decoder.decode(header);
   const { status, statusText, headersList } = parseHeader(headerStr);
+  const headers = new Headers(headersList);
+
+  if (NULL_BODY_STATUSES.includes(status)) {
+    await reader.cancel();
+    return new Response(null, { status, statusText, headers });
+  }
+
+  let body = new ReadableStream<Uint8Array>({
+    start(controller) {
+      if (rest.byteLength > 0) {
+        controller.enqueue(rest);
+      }
+    },
+    async pull(controller) {
+      const { done, value } = await reader.read();
+      if (done) {
+        controller.close();
+      } else {
+        controller.enqueue(value);
+      }
+    },
+    cancel(reason) {
+      return reader.cancel(reason);
+    },
+  });
+
+  if (headers.get('Transfer-Encoding')?.toLowerCase() === 'chunked') {
+    headers.delete('Transfer-Encoding');
+
+    if (headers.has('Trailer')) {
+      const trailersList: [string, string][] = [];
+      const decoded = body.pipeThrough(chunkedDecoder((trailer) => trailersList.push(trailer)));
+      let bufferedBody;
+      try {
+        bufferedBody = await new Response(decoded).arrayBuffer();
+      } catch {
+        return Response.error();
+      }
+      trailersList.forEach(([k, v]) => headers.append(k, v));
+
+      return new Response(bufferedBody, { status, statusText, headers });
+    }
+
+    body = body.pipeThrough(chunkedDecoder(() => {}));
+  }
 
   return new Response(body, {
     status,
     statusText,
-    headers: new Headers(headersList),
+    headers,
+  });
+}
+
+// chunkedDecoder decodes a body sent with chunked transfer coding as it's received, passing the
+// trailers that follow it to onTrailer. The stream errors if the body is malformed or incomplete.
+function chunkedDecoder(onTrailer: (trailer: [string, string]) => void) {
+  // The decoder expects a chunk's size line, its data, the CRLF after its data, or a trailer line,
+  // until the empty line after the trailers.
+  let state: 'size' | 'data' | 'dataEnd' | 'trailer' | 'done' = 'size';
+  let remaining = 0;
+  let buffered = new Uint8Array(0);
+
+  return new TransformStream<Uint8Array, Uint8Array>({
+    transform(chunk, controller) {
+      buffered = concat(buffered, chunk);
+
+      for (;;) {
+        if (state === 'size' || state === 'trailer') {
+          const lineEnd = findCRLFIndex(buffered, 0);
+          if (lineEnd === -1) {
+            return;
+          }
+          const line = decoder.decode(buffered.subarray(0, lineEnd));
+          buffered = buffered.subarray(lineEnd + 2);
+
+          if (state === 'trailer') {
+            if (line === '') {
+              state = 'done';
+            } else {
+              onTrailer(parseHeaderField(line));
+            }
+            continue;
+          }
+
+          // Chunk extensions, after a semicolon, are ignored.
+          const sizeStr = line.split(';')[0].trim();
+          if (!/^[0-9a-fA-F]+$/.test(sizeStr)) {
+            controller.error(new Error('malformed chunked body'));
+            return;
+          }
+          remaining = parseInt(sizeStr, 16);
+          state = remaining === 0 ? 'trailer' : 'data';
+        } else if (state === 'data') {
+          if (buffered.byteLength === 0) {
+            return;
+          }
+          const n = Math.min(remaining, buffered.byteLength);
+          controller.enqueue(buffered.slice(0, n));
+          buffered = buffered.subarray(n);
+          remaining -= n;
+          if (remaining === 0) {
+            state = 'dataEnd';
+          }
+        } else if (state === 'dataEnd') {
+          if (buffered.byteLength < 2) {
+            return;
+          }
+          if (buffered[0] !== CRLF_ENCODED[0] || buffered[1] !== CRLF_ENCODED[1]) {
+            controller.error(new Error('malformed chunked body'));
+            return;
+          }
+          buffered = buffered.subarray(2);
+          state = 'size';
+        } else {
+          // Anything after the trailers is ignored.
+          buffered = new Uint8Array(0);
+          return;
+        }
+      }
+    },
+    flush(controller) {
+      if (state !== 'done') {
+        controller.error(new Error('incomplete chunked body'));
+      }
+    },
   });
 }
 
+// concat returns a followed by b, without copying either if the other is empty.
+function concat(a: Uint8Array, b: Uint8Array): Uint8Array {
+  if (a.byteLength === 0) {
+    return b;
+  }
+  if (b.byteLength === 0) {
+    return a;
+  }
+
+  const out = new Uint8Array(a.byteLength + b.byteLength);
+  out.set(a, 0);
+  out.set(b, a.byteLength);
+
+  return out;
+}
+
 function findHeaderEndIndex(arr: Uint8Array): number {
   const [cr, lf] = CRLF_ENCODED;
   for (let i = 0; i < arr.length - 3; i++) {
@@ -86,6 +287,17 @@ function findHeaderEndIndex(arr: Uint8Array): number {
   return -1;
 }
 
+function findCRLFIndex(arr: Uint8Array, start: number): number {
+  const [cr, lf] = CRLF_ENCODED;
+  for (let i = start; i < arr.length - 1; i++) {
+    if (arr[i] === cr && arr[i + 1] === lf) {
+      return i;
+    }
+  }
+
+  return -1;
+}
+
 function parseHeader(header: string) {
   const [requestLine, ...headerFieldLines] = header.split(CRLF);
 
@@ -93,10 +305,12 @@ function parseHeader(header: string) {
   const status = parseInt(statusStr);
   const statusText = statusTextParts.join(' ');
 
-  const headersList = headerFieldLines.map<[string, string]>((s) => {
-    const [name, ...valueParts] = s.split(':');
-    return [name, valueParts.join(':').slice(1)];
-  });
+  const headersList = headerFieldLines.map(parseHeaderField);
 
   return { status, statusText, headersList };
 }
+
+function parseHeaderField(s: string): [string, string] {
+  const [name, ...valueParts] = s.split(':');
+  return [name, valueParts.join(':').slice(1)];
+}
@@ -11,7 +11,8 @@ sw.addEventListener('activate', (ev) => {
 });
 
 let id = 1;
-const responseResolvers = new Map<number, (value: Response) => void>();
+// Responses are posted by the tunnel client as they're received.
+const responses = new Map<number, ReadableStreamDefaultController<Uint8Array>>();
 
 const tunnelPattern = /^\/tunnel/;
 
@@ -25,32 +26,25 @@ sw.addEventListener('fetch', (ev) => {
 });
 
 sw.addEventListener('message', (ev) => {
-  if (ev.data.type === 'response') {
-    const { id, serialized } = ev.data as {
-      id: number;
-      serialized: ArrayBuffer;
-    };
-    const res = deserializeResponse(serialized);
-
-    if (res.status >= 300 && res.status <= 399) {
-      const location = res.headers.get('Location');
-      const absLocation = res.headers.get('Web-P2p-Tunnel-Abs-Location');
-
-      if (location && absLocation) {
-        res.headers.set('Location', absLocation);
-      }
-
-      res.headers.delete('Web-P2p-Tunnel-Abs-Location');
-    }
+  const { type, id } = ev.data as { type: string; id: number };
+  if (!type.startsWith('response')) {
+    return;
+  }
 
-    const resolve = responseResolvers.get(id);
-    if (!resolve) {
-      console.warn(`Received response with unknown id ${id}`);
-      return;
-    }
+  const controller = responses.get(id);
+  if (!controller) {
+    console.warn(`Received response with unknown id ${id}`);
+    return;
+  }
 
-    resolve(res);
-    responseResolvers.delete(id);
+  if (type === 'response') {
+    controller.enqueue(ev.data.chunk);
+  } else if (type === 'responseEnd') {
+    controller.close();
+    responses.delete(id);
+  } else if (type === 'responseError') {
+    controller.error(new Error('failed to tunnel response'));
+    responses.delete(id);
   }
 });
 
@@ -77,29 +71,86 @@ async function tunnelRequest(ev: FetchEvent): Promise<Response> {
   headers.forEach((value, key) => {
     headersList.push([key, value]);
   });
-  const hasBody = ev.request.body !== null;
-  const serialized = await serializeRequest(ev.request, {
+  const { header, body } = await serializeRequest(ev.request, {
     origin: sw.origin,
     userAgent: sw.navigator.userAgent,
   });
 
-  const resPromise = new Promise<Response>((resolve) => {
-    responseResolvers.set(id, resolve);
+  const reqID = id++;
+  const serialized = new ReadableStream<Uint8Array>({
+    start(controller) {
+      responses.set(reqID, controller);
+    },
+    cancel() {
+      // The page stopped reading the response, so the tunnel client stops tunneling it.
+      responses.delete(reqID);
+      tc.postMessage({ type: 'responseCancel', id: reqID });
+    },
   });
 
   tc.postMessage(
     {
       type: 'request',
-      id,
+      id: reqID,
       method,
       url,
       headersList,
-      hasBody,
-      serialized,
+      hasBody: body !== null,
+      serialized: header,
     },
-    [serialized],
+    [header],
   );
-  id++;
+  if (body !== null) {
+    streamRequestBody(tc, reqID, body);
+  }
+
+  return tunnelResponse(await deserializeResponse(serialized));
+}
+
+// tunnelResponse applies the tunnel's response headers to res.
+function tunnelResponse(res: Response): Response {
+  if (res.type === 'error') {
+    return res;
+  }
+
+  // Network errors, like redirects in error mode, are marked by the tunnel.
+  if (res.headers.get('Web-P2p-Tunnel-Response-Type') === 'error') {
+    return Response.error();
+  }
+  res.headers.delete('Web-P2p-Tunnel-Response-Type');
+
+  if (res.status >= 300 && res.status <= 399) {
+    const location = res.headers.get('Location');
+    const absLocation = res.headers.get('Web-P2p-Tunnel-Abs-Location');
+
+    if (location && absLocation) {
+      res.headers.set('Location', absLocation);
+    }
+
+    res.headers.delete('Web-P2p-Tunnel-Abs-Location');
+  }
+
+  return res;
+}
+
+// streamRequestBody posts the serialized body of request id to the tunnel client as it's read, so
+// that it's tunneled without being buffered.
+async function streamRequestBody(tc: Client, id: number, body: ReadableStream<Uint8Array>) {
+  const reader = body.getReader();
+  try {
+    for (;;) {
+      const { done, value } = await reader.read();
+      if (done) {
+        break;
+      }
+
+      tc.postMessage({ type: 'requestBody', id, chunk: value }, [value.buffer]);
+    }
+  } catch (error) {
+    console.warn(`Failed to read body of request ${id}`, error);
+    tc.postMessage({ type: 'requestBodyError', id });
+    return;
+  }
 
-  return await resPromise;
+  tc.postMessage({ type: 'requestBodyEnd', id });
 }